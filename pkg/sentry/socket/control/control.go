@@ -545,10 +545,16 @@ func Parse(t *kernel.Task, socketOrEndpoint any, buf []byte, width uint) (socket
 				if length < linux.SizeOfControlMessageTClass {
 					return socket.ControlMessages{}, linuxerr.EINVAL
 				}
-				cmsgs.IP.HasTClass = true
-				var tclass primitive.Uint32
+				var tclass primitive.Int32
 				tclass.UnmarshalUnsafe(buf)
-				cmsgs.IP.TClass = uint32(tclass)
+				if tclass < -1 || tclass > math.MaxUint8 {
+					return socket.ControlMessages{}, linuxerr.EINVAL
+				}
+				// -1 means the socket's traffic class is used.
+				if tclass != -1 {
+					cmsgs.IP.HasTClass = true
+					cmsgs.IP.TClass = uint32(tclass)
+				}
 
 			case linux.IPV6_PKTINFO:
 				if length < linux.SizeOfControlMessageIPv6PacketInfo {
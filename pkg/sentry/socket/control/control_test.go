@@ -17,6 +17,7 @@
 package control
 
 import (
+	"math"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -59,6 +60,60 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestParseTClass(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		tclass  int32
+		want    socket.IPControlMessages
+		wantErr error
+	}{
+		{
+			name:   "default",
+			tclass: -1,
+		},
+		{
+			name:   "zero",
+			tclass: 0,
+			want:   socket.IPControlMessages{HasTClass: true, TClass: 0},
+		},
+		{
+			name:   "max",
+			tclass: math.MaxUint8,
+			want:   socket.IPControlMessages{HasTClass: true, TClass: math.MaxUint8},
+		},
+		{
+			name:    "below default",
+			tclass:  -2,
+			wantErr: linuxerr.EINVAL,
+		},
+		{
+			name:    "above max",
+			tclass:  math.MaxUint8 + 1,
+			wantErr: linuxerr.EINVAL,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			length := linux.SizeOfControlMessageHeader + linux.SizeOfControlMessageTClass
+			hdr := linux.ControlMessageHeader{
+				Length: uint64(length),
+				Level:  linux.SOL_IPV6,
+				Type:   linux.IPV6_TCLASS,
+			}
+			buf := make([]byte, 0, length)
+			buf = binary.Marshal(buf, hostarch.ByteOrder, &hdr)
+			buf = binary.AppendUint32(buf, hostarch.ByteOrder, uint32(test.tclass))
+
+			cmsg, err := Parse(nil, nil, buf, 8 /* width */)
+			if err != test.wantErr {
+				t.Fatalf("got Parse(_, _, %+v, _) = (_, %v), want = (_, %v)", buf, err, test.wantErr)
+			}
+			if diff := cmp.Diff(socket.ControlMessages{IP: test.want}, cmsg); diff != "" {
+				t.Errorf("unexpected message parsed, (-want, +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestParseRightsNegativeLength(t *testing.T) {
 	// Craft the control message to parse.
 	length := uint64(linux.SizeOfControlMessageHeader) + 128
@@ -37,6 +37,7 @@ import (
 	"golang.org/x/sys/unix"
 	"gvisor.dev/gvisor/pkg/abi/linux"
 	"gvisor.dev/gvisor/pkg/abi/linux/errno"
+	"gvisor.dev/gvisor/pkg/atomicbitops"
 	"gvisor.dev/gvisor/pkg/context"
 	"gvisor.dev/gvisor/pkg/errors/linuxerr"
 	"gvisor.dev/gvisor/pkg/hostarch"
@@ -58,7 +59,6 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
-	"gvisor.dev/gvisor/pkg/tcpip/transport"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/usermem"
 	"gvisor.dev/gvisor/pkg/waiter"
@@ -356,7 +356,9 @@ type sock struct {
 	socket.SendReceiveTimeout
 	*waiter.Queue
 
-	family   int
+	// family is the socket's address family. It only changes when an IPv6
+	// socket is converted to IPv4 with IPV6_ADDRFORM.
+	family   atomicbitops.Int32
 	Endpoint tcpip.Endpoint
 	skType   linux.SockType
 	protocol int
@@ -398,7 +400,7 @@ func New(t *kernel.Task, family int, skType linux.SockType, protocol int, queue
 	namespace := t.NetworkNamespace()
 	s := &sock{
 		Queue:     queue,
-		family:    family,
+		family:    atomicbitops.FromInt32(int32(family)),
 		Endpoint:  endpoint,
 		skType:    skType,
 		protocol:  protocol,
@@ -516,7 +518,7 @@ func (s *sock) Accept(t *kernel.Task, peerRequested bool, flags int, blocking bo
 		}
 	}
 
-	ns, err := New(t, s.family, s.skType, s.protocol, wq, ep)
+	ns, err := New(t, s.addressFamily(), s.skType, s.protocol, wq, ep)
 	if err != nil {
 		return 0, nil, 0, err
 	}
@@ -530,7 +532,7 @@ func (s *sock) Accept(t *kernel.Task, peerRequested bool, flags int, blocking bo
 	var addrLen uint32
 	if peerAddr != nil {
 		// Get address of the peer and write it to peer slice.
-		addr, addrLen = socket.ConvertAddress(s.family, *peerAddr)
+		addr, addrLen = socket.ConvertAddress(s.addressFamily(), *peerAddr)
 	}
 
 	fd, e := t.NewFDFrom(0, ns, kernel.FDFlags{
@@ -575,7 +577,7 @@ func (s *sock) GetSockOpt(t *kernel.Task, level, name int, outPtr hostarch.Addr,
 		return &val, nil
 	}
 
-	return GetSockOpt(t, s, s.Endpoint, s.family, s.skType, level, name, outPtr, outLen)
+	return GetSockOpt(t, s, s.Endpoint, s.addressFamily(), s.skType, level, name, outPtr, outLen)
 }
 
 // SetSockOpt implements the linux syscall setsockopt(2) for sockets backed by
@@ -617,7 +619,7 @@ var sockAddrLinkSize = (*linux.SockAddrLink)(nil).SizeBytes()
 func (s *sock) minSockAddrLen() int {
 	const addressFamilySize = 2
 
-	switch s.family {
+	switch s.addressFamily() {
 	case linux.AF_UNIX:
 		return addressFamilySize
 	case linux.AF_INET:
@@ -629,10 +631,15 @@ func (s *sock) minSockAddrLen() int {
 	case linux.AF_UNSPEC:
 		return addressFamilySize
 	default:
-		panic(fmt.Sprintf("s.family unrecognized = %d", s.family))
+		panic(fmt.Sprintf("s.family unrecognized = %d", s.addressFamily()))
 	}
 }
 
+// addressFamily returns the socket's address family.
+func (s *sock) addressFamily() int {
+	return int(s.family.Load())
+}
+
 func (s *sock) isPacketBased() bool {
 	return s.skType == linux.SOCK_DGRAM || s.skType == linux.SOCK_SEQPACKET || s.skType == linux.SOCK_RDM || s.skType == linux.SOCK_RAW
 }
@@ -648,10 +655,10 @@ func (s *sock) Readiness(mask waiter.EventMask) waiter.EventMask {
 // If exact is true, then the specified address family must be an exact match
 // with the socket's family.
 func (s *sock) checkFamily(family uint16, exact bool) bool {
-	if family == uint16(s.family) {
+	if family == uint16(s.addressFamily()) {
 		return true
 	}
-	if !exact && family == linux.AF_INET && s.family == linux.AF_INET6 {
+	if !exact && family == linux.AF_INET && s.addressFamily() == linux.AF_INET6 {
 		if !s.Endpoint.SocketOptions().GetV6Only() {
 			return true
 		}
@@ -667,7 +674,7 @@ func (s *sock) checkFamily(family uint16, exact bool) bool {
 //
 // TODO(gvisor.dev/issue/1556): remove this function.
 func (s *sock) mapFamily(addr tcpip.FullAddress, family uint16) tcpip.FullAddress {
-	if addr.Addr.BitLen() == 0 && s.family == linux.AF_INET6 && family == linux.AF_INET {
+	if addr.Addr.BitLen() == 0 && s.addressFamily() == linux.AF_INET6 && family == linux.AF_INET {
 		addr.Addr = tcpip.AddrFrom16([16]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00})
 	}
 	return addr
@@ -708,7 +715,7 @@ func (s *sock) Connect(t *kernel.Task, sockaddr []byte, blocking bool) *syserr.E
 	switch err := s.Endpoint.Connect(addr); err.(type) {
 	case *tcpip.ErrConnectStarted, *tcpip.ErrAlreadyConnecting:
 	case *tcpip.ErrNoPortAvailable:
-		if (s.family == unix.AF_INET || s.family == unix.AF_INET6) && s.skType == linux.SOCK_STREAM {
+		if family := s.addressFamily(); (family == unix.AF_INET || family == unix.AF_INET6) && s.skType == linux.SOCK_STREAM {
 			// TCP unlike UDP returns EADDRNOTAVAIL when it can't
 			// find an available local ephemeral port.
 			return syserr.ErrAddressNotAvailable
@@ -1375,6 +1382,22 @@ func getSockOptIPv6(t *kernel.Task, s socket.Socket, ep commonEndpoint, name int
 		v := primitive.Int32(boolToInt32(ep.SocketOptions().GetV6Only()))
 		return &v, nil
 
+	case linux.IPV6_UNICAST_IF:
+		if outLen < sizeOfInt32 {
+			return nil, syserr.ErrInvalidArgument
+		}
+
+		v, err := ep.GetSockOptInt(tcpip.IPv6UnicastInterfaceOption)
+		if err != nil {
+			return nil, syserr.TranslateNetstackError(err)
+		}
+
+		// The interface index is returned in network byte order.
+		var b [sizeOfInt32]byte
+		binary.BigEndian.PutUint32(b[:], uint32(v))
+		vP := primitive.Int32(hostarch.ByteOrder.Uint32(b[:]))
+		return &vP, nil
+
 	case linux.IPV6_UNICAST_HOPS:
 		if outLen < sizeOfInt32 {
 			return nil, syserr.ErrInvalidArgument
@@ -1608,6 +1631,34 @@ func getSockOptIP(t *kernel.Task, s socket.Socket, ep commonEndpoint, name int,
 		v := primitive.Int32(boolToInt32(ep.SocketOptions().GetMulticastLoop()))
 		return &v, nil
 
+	case linux.IP_MULTICAST_ALL:
+		if outLen < sizeOfInt32 {
+			return nil, syserr.ErrInvalidArgument
+		}
+
+		v, err := ep.GetSockOptInt(tcpip.MulticastAllOption)
+		if err != nil {
+			return nil, syserr.TranslateNetstackError(err)
+		}
+		vP := primitive.Int32(v)
+		return &vP, nil
+
+	case linux.IP_UNICAST_IF:
+		if outLen < sizeOfInt32 {
+			return nil, syserr.ErrInvalidArgument
+		}
+
+		v, err := ep.GetSockOptInt(tcpip.UnicastInterfaceOption)
+		if err != nil {
+			return nil, syserr.TranslateNetstackError(err)
+		}
+
+		// The interface index is returned in network byte order.
+		var b [sizeOfInt32]byte
+		binary.BigEndian.PutUint32(b[:], uint32(v))
+		vP := primitive.Int32(hostarch.ByteOrder.Uint32(b[:]))
+		return &vP, nil
+
 	case linux.IP_TOS:
 		// Length handling for parity with Linux.
 		if outLen == 0 {
@@ -2169,12 +2220,42 @@ func setSockOptIPv6(t *kernel.Task, s socket.Socket, ep commonEndpoint, name int
 
 		if socket.IsTCP(s) && tcp.EndpointState(ep.State()) != tcp.StateInitial {
 			return syserr.ErrInvalidEndpointState
-		} else if socket.IsUDP(s) && transport.DatagramEndpointState(ep.State()) != transport.DatagramEndpointStateInitial {
-			return syserr.ErrInvalidEndpointState
 		}
 
 		v := hostarch.ByteOrder.Uint32(optVal)
-		ep.SocketOptions().SetV6Only(v != 0)
+		return syserr.TranslateNetstackError(ep.SocketOptions().SetV6Only(v != 0))
+
+	case linux.IPV6_UNICAST_IF:
+		if len(optVal) != sizeOfInt32 {
+			return syserr.ErrInvalidArgument
+		}
+
+		// The interface index is in network byte order.
+		v := int32(binary.BigEndian.Uint32(optVal))
+		return syserr.TranslateNetstackError(ep.SetSockOptInt(tcpip.IPv6UnicastInterfaceOption, int(v)))
+
+	case linux.IPV6_ADDRFORM:
+		if len(optVal) < sizeOfInt32 {
+			return syserr.ErrInvalidArgument
+		}
+
+		// Only conversion to IPv4 is supported, as in Linux.
+		if v := int32(hostarch.ByteOrder.Uint32(optVal)); v != linux.AF_INET {
+			return syserr.ErrInvalidArgument
+		}
+		// Only UDP endpoints support the conversion; Linux also converts
+		// established TCP sockets, which netstack does not support.
+		sk, ok := s.(*sock)
+		if !ok || !socket.IsUDP(s) {
+			return syserr.ErrUnknownProtocolOption
+		}
+		if err := ep.SetSockOptInt(tcpip.IPv6AddrFormOption, int(header.IPv4ProtocolNumber)); err != nil {
+			return syserr.TranslateNetstackError(err)
+		}
+
+		// The socket is now an IPv4 socket; its addresses are reported as such
+		// and IPv6 options no longer apply.
+		sk.family.Store(linux.AF_INET)
 		return nil
 
 	case linux.IPV6_ADD_MEMBERSHIP:
@@ -2441,6 +2522,23 @@ func setSockOptIP(t *kernel.Task, s socket.Socket, ep commonEndpoint, name int,
 		ep.SocketOptions().SetMulticastLoop(v != 0)
 		return nil
 
+	case linux.IP_MULTICAST_ALL:
+		v, err := parseIntOrChar(optVal)
+		if err != nil {
+			return err
+		}
+
+		return syserr.TranslateNetstackError(ep.SetSockOptInt(tcpip.MulticastAllOption, int(v)))
+
+	case linux.IP_UNICAST_IF:
+		if len(optVal) != sizeOfInt32 {
+			return syserr.ErrInvalidArgument
+		}
+
+		// The interface index is in network byte order.
+		v := int32(binary.BigEndian.Uint32(optVal))
+		return syserr.TranslateNetstackError(ep.SetSockOptInt(tcpip.UnicastInterfaceOption, int(v)))
+
 	case linux.MCAST_JOIN_GROUP:
 		// FIXME(b/124219304): Implement MCAST_JOIN_GROUP.
 		return syserr.ErrInvalidArgument
@@ -2561,7 +2659,6 @@ func setSockOptIP(t *kernel.Task, s socket.Socket, ep commonEndpoint, name int,
 		linux.IP_MINTTL,
 		linux.IP_MSFILTER,
 		linux.IP_MTU_DISCOVER,
-		linux.IP_MULTICAST_ALL,
 		linux.IP_NODEFRAG,
 		linux.IP_OPTIONS,
 		linux.IP_PASSSEC,
@@ -2570,7 +2667,6 @@ func setSockOptIP(t *kernel.Task, s socket.Socket, ep commonEndpoint, name int,
 		linux.IP_RETOPTS,
 		linux.IP_TRANSPARENT,
 		linux.IP_UNBLOCK_SOURCE,
-		linux.IP_UNICAST_IF,
 		linux.IP_XFRM_POLICY,
 		linux.MCAST_BLOCK_SOURCE,
 		linux.MCAST_JOIN_SOURCE_GROUP,
@@ -2592,7 +2688,7 @@ func (s *sock) GetSockName(*kernel.Task) (linux.SockAddr, uint32, *syserr.Error)
 		return nil, 0, syserr.TranslateNetstackError(err)
 	}
 
-	a, l := socket.ConvertAddress(s.family, addr)
+	a, l := socket.ConvertAddress(s.addressFamily(), addr)
 	return a, l, nil
 }
 
@@ -2604,7 +2700,7 @@ func (s *sock) GetPeerName(*kernel.Task) (linux.SockAddr, uint32, *syserr.Error)
 		return nil, 0, syserr.TranslateNetstackError(err)
 	}
 
-	a, l := socket.ConvertAddress(s.family, addr)
+	a, l := socket.ConvertAddress(s.addressFamily(), addr)
 	return a, l, nil
 }
 
@@ -2683,7 +2779,7 @@ func (s *sock) nonBlockingRead(ctx context.Context, dst usermem.IOSequence, peek
 		var addr linux.SockAddr
 		var addrLen uint32
 		if senderRequested {
-			addr, addrLen = socket.ConvertAddress(s.family, res.RemoteAddr)
+			addr, addrLen = socket.ConvertAddress(s.addressFamily(), res.RemoteAddr)
 			switch v := addr.(type) {
 			case *linux.SockAddrLink:
 				v.Protocol = socket.Htons(uint16(res.LinkPacketInfo.Protocol))
@@ -2730,7 +2826,7 @@ func (s *sock) nonBlockingRead(ctx context.Context, dst usermem.IOSequence, peek
 }
 
 func (s *sock) netstackToLinuxControlMessages(cm tcpip.ReceivableControlMessages) socket.ControlMessages {
-	readCM := socket.NewIPControlMessages(s.family, cm)
+	readCM := socket.NewIPControlMessages(s.addressFamily(), cm)
 	return socket.ControlMessages{
 		IP: socket.IPControlMessages{
 			HasTimestamp:       readCM.HasTimestamp && s.sockOptTimestamp,
@@ -2761,6 +2857,8 @@ func (s *sock) linuxToNetstackControlMessages(cm socket.ControlMessages) tcpip.S
 		TTL:         uint8(cm.IP.TTL),
 		HasHopLimit: cm.IP.HasHopLimit,
 		HopLimit:    uint8(cm.IP.HopLimit),
+		HasTClass:   cm.IP.HasTClass,
+		TClass:      uint8(cm.IP.TClass),
 	}
 }
 
@@ -2828,7 +2926,7 @@ func (s *sock) recvErr(t *kernel.Task, dst usermem.IOSequence) (int, int, linux.
 	// The original destination address of the datagram that caused the error is
 	// supplied via msg_name.  -- recvmsg(2)
 	dstAddr, dstAddrLen := socket.ConvertAddress(addrFamilyFromNetProto(sockErr.NetProto), sockErr.Dst)
-	cmgs := socket.ControlMessages{IP: socket.NewIPControlMessages(s.family, tcpip.ReceivableControlMessages{SockErr: sockErr})}
+	cmgs := socket.ControlMessages{IP: socket.NewIPControlMessages(s.addressFamily(), tcpip.ReceivableControlMessages{SockErr: sockErr})}
 	return n, msgFlags, dstAddr, dstAddrLen, cmgs, syserr.FromError(err)
 }
 
@@ -3325,7 +3423,7 @@ func nicStateFlagsToLinux(f stack.NICStateFlags) uint32 {
 // State implements socket.Socket.State. State translates the internal state
 // returned by netstack to values defined by Linux.
 func (s *sock) State() uint32 {
-	if s.family != linux.AF_INET && s.family != linux.AF_INET6 {
+	if family := s.addressFamily(); family != linux.AF_INET && family != linux.AF_INET6 {
 		// States not implemented for this socket's family.
 		return 0
 	}
@@ -3376,7 +3474,7 @@ func (s *sock) State() uint32 {
 		// TODO(b/112063468): Export states for raw sockets.
 	default:
 		// Unknown transport protocol, how did we make this socket?
-		log.Warningf("Unknown transport protocol for an existing socket: family=%v, type=%v, protocol=%v, internal type %v", s.family, s.skType, s.protocol, reflect.TypeOf(s.Endpoint).Elem())
+		log.Warningf("Unknown transport protocol for an existing socket: family=%v, type=%v, protocol=%v, internal type %v", s.addressFamily(), s.skType, s.protocol, reflect.TypeOf(s.Endpoint).Elem())
 		return 0
 	}
 
@@ -3385,7 +3483,7 @@ func (s *sock) State() uint32 {
 
 // Type implements socket.Socket.Type.
 func (s *sock) Type() (family int, skType linux.SockType, protocol int) {
-	return s.family, s.skType, s.protocol
+	return s.addressFamily(), s.skType, s.protocol
 }
 
 // EventRegister implements waiter.Waitable.
@@ -453,12 +453,21 @@ func (e *endpoint) addIPHeader(srcAddr, dstAddr tcpip.Address, pkt stack.PacketB
 		return &tcpip.ErrMessageTooLong{}
 	}
 	// RFC 6864 section 4.3 mandates uniqueness of ID values for non-atomic
-	// datagrams. Since the DF bit is never being set here, all datagrams
-	// are non-atomic and need an ID.
-	id := e.protocol.ids[hashRoute(srcAddr, dstAddr, params.Protocol, e.protocol.hashIV)%buckets].Add(1)
+	// datagrams. Atomic datagrams (with the DF bit set) are assigned an ID as
+	// well, which the RFC permits. A caller supplied ID is used as is; its
+	// uniqueness is the caller's responsibility.
+	id := params.ID
+	if !params.HasID {
+		id = uint16(e.protocol.ids[hashRoute(srcAddr, dstAddr, params.Protocol, e.protocol.hashIV)%buckets].Add(1))
+	}
+	var flags uint8
+	if params.DF {
+		flags = header.IPv4FlagDontFragment
+	}
 	ipH.Encode(&header.IPv4Fields{
 		TotalLength: uint16(length),
-		ID:          uint16(id),
+		ID:          id,
+		Flags:       flags,
 		TTL:         params.TTL,
 		TOS:         params.TOS,
 		Protocol:    uint8(params.Protocol),
@@ -568,9 +577,9 @@ func (e *endpoint) writePacketPostRouting(r *stack.Route, pkt stack.PacketBuffer
 
 	if packetMustBeFragmented(pkt, networkMTU) {
 		h := header.IPv4(pkt.NetworkHeader().Slice())
-		if h.Flags()&header.IPv4FlagDontFragment != 0 && pkt.NetworkPacketInfo.IsForwardedPacket {
+		if h.Flags()&header.IPv4FlagDontFragment != 0 && (pkt.NetworkPacketInfo.IsForwardedPacket || !headerIncluded) {
 			// TODO(gvisor.dev/issue/5919): Handle error condition in which DontFragment
-			// is set but the packet must be fragmented for the non-forwarding case.
+			// is set but a header-included packet must be fragmented.
 			return &tcpip.ErrMessageTooLong{}
 		}
 		sent, remain, err := e.handleFragments(r, networkMTU, pkt, func(fragPkt stack.PacketBufferPtr) tcpip.Error {
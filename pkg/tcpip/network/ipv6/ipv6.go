@@ -801,6 +801,18 @@ func (e *endpoint) WritePacket(r *stack.Route, params stack.NetworkHeaderParams,
 		return err
 	}
 
+	// Packets that must not be fragmented are rejected rather than fragmented
+	// when they do not fit the MTU.
+	if params.DF {
+		networkMTU, err := calculateNetworkMTU(e.nic.MTU(), uint32(len(pkt.NetworkHeader().Slice())))
+		if err != nil {
+			return err
+		}
+		if packetMustBeFragmented(pkt, networkMTU) {
+			return &tcpip.ErrMessageTooLong{}
+		}
+	}
+
 	// iptables filtering. All packets that reach here are locally
 	// generated.
 	outNicName := e.protocol.stack.FindNICNameFromID(e.nic.ID())
@@ -49,6 +49,14 @@ type SocketOptionsHandler interface {
 	// HasNIC is invoked to check if the NIC is valid for SO_BINDTODEVICE.
 	HasNIC(v int32) bool
 
+	// OnSetBindToDevice is invoked before SO_BINDTODEVICE is changed for an
+	// endpoint. The option is not changed if an error is returned.
+	OnSetBindToDevice(v int32) Error
+
+	// OnSetV6Only is invoked before IPV6_V6ONLY is changed for an endpoint. The
+	// option is not changed if an error is returned.
+	OnSetV6Only(v bool) Error
+
 	// OnSetSendBufferSize is invoked when the send buffer size for an endpoint is
 	// changed. The handler is invoked with the new value for the socket send
 	// buffer size. It also returns the newly set value.
@@ -99,6 +107,16 @@ func (*DefaultSocketOptionsHandler) HasNIC(int32) bool {
 	return false
 }
 
+// OnSetBindToDevice implements SocketOptionsHandler.OnSetBindToDevice.
+func (*DefaultSocketOptionsHandler) OnSetBindToDevice(int32) Error {
+	return nil
+}
+
+// OnSetV6Only implements SocketOptionsHandler.OnSetV6Only.
+func (*DefaultSocketOptionsHandler) OnSetV6Only(bool) Error {
+	return nil
+}
+
 // OnSetSendBufferSize implements SocketOptionsHandler.OnSetSendBufferSize.
 func (*DefaultSocketOptionsHandler) OnSetSendBufferSize(v int64) (newSz int64) {
 	return v
@@ -428,9 +446,15 @@ func (so *SocketOptions) GetV6Only() bool {
 
 // SetV6Only sets value for IPV6_V6ONLY option.
 //
-// Preconditions: the backing TCP or UDP endpoint must be in initial state.
-func (so *SocketOptions) SetV6Only(v bool) {
+// Preconditions: the backing TCP endpoint must be in initial state. Datagram
+// endpoints reject the change once bound.
+func (so *SocketOptions) SetV6Only(v bool) Error {
+	if err := so.handler.OnSetV6Only(v); err != nil {
+		return err
+	}
+
 	storeAtomicBool(&so.v6OnlyEnabled, v)
+	return nil
 }
 
 // GetQuickAck gets value for TCP_QUICKACK option.
@@ -674,6 +698,9 @@ func (so *SocketOptions) SetBindToDevice(bindToDevice int32) Error {
 	if bindToDevice != 0 && !so.handler.HasNIC(bindToDevice) {
 		return &ErrUnknownDevice{}
 	}
+	if err := so.handler.OnSetBindToDevice(bindToDevice); err != nil {
+		return err
+	}
 
 	so.bindToDevice.Store(bindToDevice)
 	return nil
@@ -319,6 +319,17 @@ type NetworkHeaderParams struct {
 
 	// TOS refers to TypeOfService or TrafficClass field of the IP-header.
 	TOS uint8
+
+	// DF indicates that the packet must not be fragmented. For IPv4, the don't
+	// fragment flag of the IP-header is set.
+	DF bool
+
+	// HasID indicates whether ID is valid/set.
+	HasID bool
+
+	// ID is the identification field of the IPv4 header, used instead of an
+	// allocated ID. It is ignored by IPv6.
+	ID uint16
 }
 
 // GroupAddressableEndpoint is an endpoint that supports group addressing.
@@ -465,7 +465,9 @@ func (r *Route) isResolutionRequiredRLocked() bool {
 	return len(r.remoteLinkAddress) == 0 && r.linkRes != nil && r.isValidForOutgoingRLocked() && !r.local()
 }
 
-func (r *Route) isValidForOutgoing() bool {
+// IsValidForOutgoing returns true iff the route may still be used to send
+// packets, i.e. its NICs are enabled and its local address is still assigned.
+func (r *Route) IsValidForOutgoing() bool {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	return r.isValidForOutgoingRLocked()
@@ -493,7 +495,7 @@ func (r *Route) isValidForOutgoingRLocked() bool {
 
 // WritePacket writes the packet through the given route.
 func (r *Route) WritePacket(params NetworkHeaderParams, pkt PacketBufferPtr) tcpip.Error {
-	if !r.isValidForOutgoing() {
+	if !r.IsValidForOutgoing() {
 		return &tcpip.ErrInvalidEndpointState{}
 	}
 
@@ -503,7 +505,7 @@ func (r *Route) WritePacket(params NetworkHeaderParams, pkt PacketBufferPtr) tcp
 // WriteHeaderIncludedPacket writes a packet already containing a network
 // header through the given route.
 func (r *Route) WriteHeaderIncludedPacket(pkt PacketBufferPtr) tcpip.Error {
-	if !r.isValidForOutgoing() {
+	if !r.IsValidForOutgoing() {
 		return &tcpip.ErrInvalidEndpointState{}
 	}
 
@@ -576,6 +578,12 @@ func (r *Route) IsOutboundBroadcast() bool {
 	return r.isV4Broadcast(r.RemoteAddress())
 }
 
+// IsOutgoingNICLoopback returns true if the route sends packets out of a
+// loopback interface, which loops back every packet it sends.
+func (r *Route) IsOutgoingNICLoopback() bool {
+	return r.outgoingNIC.IsLoopback()
+}
+
 // ConfirmReachable informs the network/link layer that the neighbour used for
 // the route is reachable.
 //
@@ -89,6 +89,10 @@ type Stack struct {
 	// +checklocks:routeMu
 	routeTable []tcpip.Route
 
+	// routeTableGeneration is incremented whenever the route table changes so
+	// that cached routes can be invalidated.
+	routeTableGeneration atomicbitops.Uint64
+
 	mu stackRWMutex
 	// +checklocks:mu
 	nics                     map[tcpip.NICID]*nic
@@ -99,6 +103,11 @@ type Stack struct {
 	// +checklocks:cleanupEndpointsMu
 	cleanupEndpoints map[TransportEndpoint]struct{}
 
+	// nicRemovedHandlersMu protects nicRemovedHandlers.
+	nicRemovedHandlersMu nicRemovedHandlersMutex
+	// +checklocks:nicRemovedHandlersMu
+	nicRemovedHandlers map[NICRemovedHandler]struct{}
+
 	*ports.PortManager
 
 	// If not nil, then any new endpoints will have this probe function
@@ -372,6 +381,7 @@ func New(opts Options) *Stack {
 		packetEndpointWriteSupported: opts.AllowPacketEndpointWrite,
 		defaultForwardingEnabled:     make(map[tcpip.NetworkProtocolNumber]struct{}),
 		cleanupEndpoints:             make(map[TransportEndpoint]struct{}),
+		nicRemovedHandlers:           make(map[NICRemovedHandler]struct{}),
 		PortManager:                  ports.NewPortManager(),
 		clock:                        clock,
 		stats:                        opts.Stats.FillIn(),
@@ -744,6 +754,7 @@ func (s *Stack) SetRouteTable(table []tcpip.Route) {
 	s.routeMu.Lock()
 	defer s.routeMu.Unlock()
 	s.routeTable = table
+	s.routeTableGeneration.Add(1)
 }
 
 // GetRouteTable returns the route table which is currently in use.
@@ -753,11 +764,21 @@ func (s *Stack) GetRouteTable() []tcpip.Route {
 	return append([]tcpip.Route(nil), s.routeTable...)
 }
 
+// RouteTableGeneration returns a value that changes whenever the route table
+// is modified, including when routes are removed along with a NIC.
+//
+// Callers that cache routes may compare generations to detect that a cached
+// route may no longer be the one FindRoute would return.
+func (s *Stack) RouteTableGeneration() uint64 {
+	return s.routeTableGeneration.Load()
+}
+
 // AddRoute appends a route to the route table.
 func (s *Stack) AddRoute(route tcpip.Route) {
 	s.routeMu.Lock()
 	defer s.routeMu.Unlock()
 	s.routeTable = append(s.routeTable, route)
+	s.routeTableGeneration.Add(1)
 }
 
 // RemoveRoutes removes matching routes from the route table.
@@ -772,6 +793,7 @@ func (s *Stack) RemoveRoutes(match func(tcpip.Route) bool) {
 		}
 	}
 	s.routeTable = filteredRoutes
+	s.routeTableGeneration.Add(1)
 }
 
 // NewEndpoint creates a new transport layer endpoint of the given protocol.
@@ -942,11 +964,54 @@ func (s *Stack) CheckNIC(id tcpip.NICID) bool {
 }
 
 // RemoveNIC removes NIC and all related routes from the network stack.
+//
+// The handlers added with AddNICRemovedHandler are notified once the NIC is
+// removed.
 func (s *Stack) RemoveNIC(id tcpip.NICID) tcpip.Error {
 	s.mu.Lock()
-	defer s.mu.Unlock()
+	err := s.removeNICLocked(id)
+	s.mu.Unlock()
+
+	if _, ok := err.(*tcpip.ErrUnknownNICID); ok {
+		return err
+	}
 
-	return s.removeNICLocked(id)
+	s.nicRemovedHandlersMu.Lock()
+	handlers := make([]NICRemovedHandler, 0, len(s.nicRemovedHandlers))
+	for h := range s.nicRemovedHandlers {
+		handlers = append(handlers, h)
+	}
+	s.nicRemovedHandlersMu.Unlock()
+
+	for _, h := range handlers {
+		h.OnNICRemoved(id)
+	}
+	return err
+}
+
+// NICRemovedHandler is notified when a NIC is removed from the stack.
+type NICRemovedHandler interface {
+	// OnNICRemoved is called after the NIC and its routes are removed from the
+	// stack. It is called without any of the stack's locks held.
+	OnNICRemoved(tcpip.NICID)
+}
+
+// AddNICRemovedHandler adds a handler to be notified when a NIC is removed
+// with RemoveNIC.
+func (s *Stack) AddNICRemovedHandler(h NICRemovedHandler) {
+	s.nicRemovedHandlersMu.Lock()
+	defer s.nicRemovedHandlersMu.Unlock()
+	s.nicRemovedHandlers[h] = struct{}{}
+}
+
+// RemoveNICRemovedHandler removes a handler added with AddNICRemovedHandler.
+//
+// The handler may still be notified of a NIC removal that is concurrent with
+// the call.
+func (s *Stack) RemoveNICRemovedHandler(h NICRemovedHandler) {
+	s.nicRemovedHandlersMu.Lock()
+	defer s.nicRemovedHandlersMu.Unlock()
+	delete(s.nicRemovedHandlers, h)
 }
 
 // removeNICLocked removes NIC and all related routes from the network stack.
@@ -971,6 +1036,7 @@ func (s *Stack) removeNICLocked(id tcpip.NICID) tcpip.Error {
 		}
 	}
 	s.routeTable = s.routeTable[:n]
+	s.routeTableGeneration.Add(1)
 	s.routeMu.Unlock()
 
 	return nic.remove()
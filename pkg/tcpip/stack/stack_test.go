@@ -1018,6 +1018,59 @@ func TestRemoveNIC(t *testing.T) {
 	}
 }
 
+type nicRemovedRecorder struct {
+	removed []tcpip.NICID
+}
+
+// OnNICRemoved implements stack.NICRemovedHandler.
+func (r *nicRemovedRecorder) OnNICRemoved(nicID tcpip.NICID) {
+	r.removed = append(r.removed, nicID)
+}
+
+func TestNICRemovedHandler(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+		nicID3 = 3
+	)
+
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocolFactory{fakeNetFactory},
+	})
+	for _, nicID := range []tcpip.NICID{nicID1, nicID2, nicID3} {
+		if err := s.CreateNIC(nicID, channel.New(0, defaultMTU, "")); err != nil {
+			t.Fatalf("CreateNIC(%d, _) = %s", nicID, err)
+		}
+	}
+
+	var r nicRemovedRecorder
+	s.AddNICRemovedHandler(&r)
+	if err := s.RemoveNIC(nicID1); err != nil {
+		t.Fatalf("s.RemoveNIC(%d): %s", nicID1, err)
+	}
+	// Removing an unknown NIC does not notify handlers.
+	err := s.RemoveNIC(nicID1)
+	if _, ok := err.(*tcpip.ErrUnknownNICID); !ok {
+		t.Fatalf("got s.RemoveNIC(%d) = %v, want = %s", nicID1, err, &tcpip.ErrUnknownNICID{})
+	}
+	if err := s.RemoveNIC(nicID2); err != nil {
+		t.Fatalf("s.RemoveNIC(%d): %s", nicID2, err)
+	}
+	if diff := cmp.Diff([]tcpip.NICID{nicID1, nicID2}, r.removed); diff != "" {
+		t.Errorf("removed NICs mismatch (-want +got):\n%s", diff)
+	}
+
+	// A removed handler is no longer notified.
+	s.RemoveNICRemovedHandler(&r)
+	r.removed = nil
+	if err := s.RemoveNIC(nicID3); err != nil {
+		t.Fatalf("s.RemoveNIC(%d): %s", nicID3, err)
+	}
+	if len(r.removed) != 0 {
+		t.Errorf("got removed NICs = %v after removing the handler, want none", r.removed)
+	}
+}
+
 func TestRouteWithDownNIC(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -591,6 +591,12 @@ type SendableControlMessages struct {
 	// HopLimit is the IPv6 Hop Limit of the associated packet.
 	HopLimit uint8
 
+	// HasTClass indicates whether TClass is valid/set.
+	HasTClass bool
+
+	// TClass is the IPv6 traffic class of the associated packet.
+	TClass uint8
+
 	// HasIPv6PacketInfo indicates whether IPv6PacketInfo is set.
 	HasIPv6PacketInfo bool
 
@@ -895,6 +901,20 @@ type WriteOptions struct {
 
 	// ControlMessages contains optional overrides used when writing a packet.
 	ControlMessages SendableControlMessages
+
+	// DontFragment means that the written packet must not be fragmented; its
+	// IPv4 don't fragment flag is set and the write fails with
+	// ErrMessageTooLong if the packet does not fit the outgoing interface's
+	// MTU. It only applies to this write, independent of MTUDiscoverOption.
+	DontFragment bool
+
+	// HasIPv4ID indicates whether IPv4ID is valid/set.
+	HasIPv4ID bool
+
+	// IPv4ID is the identification field of the written packet's IPv4 header,
+	// used instead of the ID the stack would allocate. It is only valid for
+	// writes sent over IPv4.
+	IPv4ID uint16
 }
 
 // SockOptInt represents socket options which values have the int type.
@@ -969,6 +989,75 @@ const (
 	// IPv6Checksum is used to request the stack to populate and validate the IPv6
 	// checksum for transport level headers.
 	IPv6Checksum
+
+	// MulticastAllOption is used by SetSockOptInt/GetSockOptInt to control
+	// whether an endpoint receives multicast packets for all groups joined on
+	// the receiving interface or only for the groups it has joined itself. A
+	// non-zero value enables the former, which is the default.
+	MulticastAllOption
+
+	// UnicastInterfaceOption is used by SetSockOptInt/GetSockOptInt to specify
+	// the interface IPv4 unicast packets are sent from when the destination
+	// does not specify one (see IP_UNICAST_IF). A zero value removes the
+	// restriction.
+	UnicastInterfaceOption
+
+	// IPv6AddrFormOption is used by GetSockOptInt to get the network protocol
+	// of an endpoint and by SetSockOptInt to convert a connected IPv6 endpoint
+	// whose peer is an IPv4-mapped address to IPv4 (see IPV6_ADDRFORM).
+	IPv6AddrFormOption
+
+	// RouteCacheSizeOption is used by SetSockOptInt/GetSockOptInt to specify
+	// the maximum number of routes a datagram endpoint caches for writes to
+	// destinations other than its connected peer. A zero value, the default,
+	// disables the cache.
+	RouteCacheSizeOption
+
+	// MulticastLoopStrictOption is used by SetSockOptInt/GetSockOptInt to
+	// specify whether writes to a multicast destination fail when multicast
+	// loopback is disabled but the outgoing interface loops back every packet
+	// (e.g. a loopback interface), instead of looping the packet back.
+	MulticastLoopStrictOption
+
+	// WriteDiagnosticsOption is used by SetSockOptInt/GetSockOptInt to specify
+	// whether a datagram endpoint records why the last rejected write was
+	// rejected. It is disabled by default.
+	WriteDiagnosticsOption
+
+	// EndpointDefaultTTLOption is used by SetSockOptInt/GetSockOptInt to
+	// specify the TTL (or hop limit) a datagram endpoint uses for unicast
+	// packets when no TTL is set with IPv4TTLOption or IPv6HopLimitOption, in
+	// place of the route's default (see DefaultTTLOption). Multicast packets
+	// use MulticastTTLOption regardless. Zero, the default, uses the route's
+	// default TTL.
+	EndpointDefaultTTLOption
+
+	// ECNOption is used by SetSockOptInt/GetSockOptInt to specify how a
+	// datagram endpoint sets the ECN field (the low 2 bits) of the TOS or
+	// traffic class of the packets it sends. Its value is one of the ECN*
+	// constants. ECNFromTOS, the default, sends the ECN bits as set with
+	// IPv4TOSOption, IPv6TrafficClassOption or a control message; any other
+	// value replaces them while keeping the DSCP bits as set.
+	ECNOption
+
+	// FloatingSourceOption is used by SetSockOptInt/GetSockOptInt to specify
+	// whether a datagram endpoint that is connected without being bound keeps
+	// an unspecified local address, instead of taking the source address of
+	// the connected route. The source address of each packet written by such
+	// an endpoint is then selected when the packet is written so it follows
+	// route changes. It is disabled by default.
+	FloatingSourceOption
+
+	// BroadcastUnrestrictedOption is used by SetSockOptInt/GetSockOptInt to
+	// specify whether a datagram endpoint may send to a broadcast destination
+	// without BroadcastOption (SO_BROADCAST) being set. It is disabled by
+	// default, matching Linux, and is only intended for trusted internal
+	// endpoints; it is not exposed to applications.
+	BroadcastUnrestrictedOption
+
+	// IPv6UnicastInterfaceOption is like UnicastInterfaceOption but for IPv6
+	// unicast packets (see IPV6_UNICAST_IF).
+	IPv6UnicastInterfaceOption
 )
 
 const (
@@ -983,6 +1072,21 @@ const (
 	UseDefaultIPv6HopLimit = -1
 )
 
+// Values for ECNOption.
+const (
+	// ECNFromTOS sends the ECN bits of the TOS or traffic class unchanged.
+	ECNFromTOS = iota
+
+	// ECNNotECT marks packets as not ECN-capable.
+	ECNNotECT
+
+	// ECNECT0 marks packets with the ECT(0) codepoint.
+	ECNECT0
+
+	// ECNECT1 marks packets with the ECT(1) codepoint.
+	ECNECT1
+)
+
 const (
 	// PMTUDiscoveryWant is a setting of the MTUDiscoverOption to use
 	// per-route settings.
@@ -1360,6 +1464,31 @@ type RemoveMembershipOption MembershipOption
 
 func (*RemoveMembershipOption) isSettableSocketOption() {}
 
+// AddMembershipsOption identifies multicast groups to join on some interfaces.
+// Either all of the groups are joined or, if any of them cannot be joined,
+// none are.
+type AddMembershipsOption []MembershipOption
+
+func (*AddMembershipsOption) isSettableSocketOption() {}
+
+// RemoveMembershipsOption identifies multicast groups to leave on some
+// interfaces. Either all of the groups are left or, if any of them cannot be
+// left, none are.
+type RemoveMembershipsOption []MembershipOption
+
+func (*RemoveMembershipsOption) isSettableSocketOption() {}
+
+// PreferredSourceOption is used by SetSockOpt/GetSockOpt to specify the source
+// address a datagram endpoint prefers for the packets it sends when it is not
+// bound to an address. The preference is only honoured when the address is
+// assigned to the interface a packet egresses; otherwise the source address is
+// selected as usual. The unspecified address removes the preference.
+type PreferredSourceOption Address
+
+func (*PreferredSourceOption) isGettableSocketOption() {}
+
+func (*PreferredSourceOption) isSettableSocketOption() {}
+
 // SocketDetachFilterOption is used by SetSockOpt to detach a previously attached
 // classic BPF filter on a given endpoint.
 type SocketDetachFilterOption int
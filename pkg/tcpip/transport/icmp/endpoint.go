@@ -139,7 +139,7 @@ func (e *endpoint) Close() {
 			panic(fmt.Sprintf("unhandled state = %s", state))
 		}
 
-		e.net.Shutdown()
+		e.net.Shutdown(tcpip.ShutdownRead | tcpip.ShutdownWrite)
 		e.net.Close()
 
 		e.rcvMu.Lock()
@@ -373,6 +373,16 @@ func (e *endpoint) HasNIC(id int32) bool {
 	return e.stack.HasNIC(tcpip.NICID(id))
 }
 
+// OnSetBindToDevice implements tcpip.SocketOptionsHandler.
+func (e *endpoint) OnSetBindToDevice(id int32) tcpip.Error {
+	return e.net.OnSetBindToDevice(tcpip.NICID(id))
+}
+
+// OnSetV6Only implements tcpip.SocketOptionsHandler.
+func (e *endpoint) OnSetV6Only(bool) tcpip.Error {
+	return e.net.OnSetV6Only()
+}
+
 // SetSockOpt implements tcpip.Endpoint.
 func (e *endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 	return e.net.SetSockOpt(opt)
@@ -545,10 +555,8 @@ func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) tcpip.Error {
 		panic(fmt.Sprintf("unhandled state = %s", state))
 	}
 
-	if flags&tcpip.ShutdownWrite != 0 {
-		if err := e.net.Shutdown(); err != nil {
-			return err
-		}
+	if err := e.net.Shutdown(flags); err != nil {
+		return err
 	}
 
 	if flags&tcpip.ShutdownRead != 0 {
@@ -18,6 +18,7 @@ package network
 
 import (
 	"fmt"
+	"math"
 
 	"gvisor.dev/gvisor/pkg/atomicbitops"
 	"gvisor.dev/gvisor/pkg/buffer"
@@ -32,23 +33,34 @@ import (
 // Endpoint is a datagram-based endpoint. It only supports sending datagrams to
 // a peer.
 //
+// Endpoint operates at the network layer and does not interpret ports; the
+// ports of addresses passed to it are ignored. Transport endpoints built on
+// Endpoint track their own ports and write them in the transport header of
+// packets built with a WriteContext.
+//
 // +stateify savable
 type Endpoint struct {
 	// The following fields must only be set once then never changed.
 	stack       *stack.Stack `state:"manual"`
 	ops         *tcpip.SocketOptions
-	netProto    tcpip.NetworkProtocolNumber
 	transProto  tcpip.TransportProtocolNumber
 	waiterQueue *waiter.Queue
 
 	mu sync.RWMutex `state:"nosave"`
 	// +checklocks:mu
 	wasBound bool
+	// boundNICID is the NIC the endpoint was explicitly bound to. It is
+	// restored as the endpoint's BindNICID when SO_BINDTODEVICE is cleared.
+	//
+	// +checklocks:mu
+	boundNICID tcpip.NICID
 	// owner is the owner of transmitted packets.
 	//
 	// +checklocks:mu
 	owner tcpip.PacketOwner
 	// +checklocks:mu
+	readShutdown bool
+	// +checklocks:mu
 	writeShutdown bool
 	// +checklocks:mu
 	effectiveNetProto tcpip.NetworkProtocolNumber
@@ -60,6 +72,11 @@ type Endpoint struct {
 	ipv4TTL uint8
 	// +checklocks:mu
 	ipv6HopLimit int16
+	// defaultTTL is the value of EndpointDefaultTTLOption. Zero means the
+	// route's default TTL is used.
+	//
+	// +checklocks:mu
+	defaultTTL uint8
 	// TODO(https://gvisor.dev/issue/6389): Use different fields for IPv4/IPv6.
 	// +checklocks:mu
 	multicastTTL uint8
@@ -69,10 +86,84 @@ type Endpoint struct {
 	// TODO(https://gvisor.dev/issue/6389): Use different fields for IPv4/IPv6.
 	// +checklocks:mu
 	multicastNICID tcpip.NICID
+	// ipv4UnicastNICID and ipv6UnicastNICID are the interfaces IPv4 and IPv6
+	// unicast packets are sent from when no other interface is specified (see
+	// IP_UNICAST_IF and IPV6_UNICAST_IF).
+	//
+	// +checklocks:mu
+	ipv4UnicastNICID tcpip.NICID
+	// +checklocks:mu
+	ipv6UnicastNICID tcpip.NICID
+	// multicastAll is the value of the IP_MULTICAST_ALL option.
+	//
+	// +checklocks:mu
+	multicastAll bool
+	// multicastLoopStrict is the value of MulticastLoopStrictOption.
+	//
+	// +checklocks:mu
+	multicastLoopStrict bool
 	// +checklocks:mu
 	ipv4TOS uint8
 	// +checklocks:mu
 	ipv6TClass uint8
+	// ecn is the value of ECNOption.
+	//
+	// +checklocks:mu
+	ecn int
+	// routeCacheSize is the maximum number of routes cached for unconnected
+	// writes (see RouteCacheSizeOption). Zero disables the cache.
+	//
+	// +checklocks:mu
+	routeCacheSize int
+	// writeDiagnostics is the value of WriteDiagnosticsOption.
+	//
+	// +checklocks:mu
+	writeDiagnostics bool
+	// floatingSource is the value of FloatingSourceOption.
+	//
+	// +checklocks:mu
+	floatingSource bool
+	// broadcastUnrestricted is the value of BroadcastUnrestrictedOption.
+	//
+	// +checklocks:mu
+	broadcastUnrestricted bool
+	// preferredSource is the value of PreferredSourceOption.
+	//
+	// +checklocks:mu
+	preferredSource tcpip.Address
+	// pathMTU is the MTU of the path to the connected peer: the smaller of the
+	// connected route's MTU and the smallest MTU reported by a packet too big
+	// error since the endpoint connected. It is zero when not connected.
+	//
+	// +checklocks:mu
+	pathMTU uint32
+	// mtuChangeHandler is called when pathMTU is lowered (see
+	// SetMTUChangeHandler).
+	//
+	// +checklocks:mu
+	mtuChangeHandler func(mtu uint32) `state:"nosave"`
+
+	// lastErrorMu protects lastError. It has a dedicated mutex as errors are
+	// delivered asynchronously, without mu held.
+	lastErrorMu sync.Mutex `state:"nosave"`
+	// lastError is the last asynchronous error (e.g. from an ICMP error) that
+	// has not been read yet (see SO_ERROR).
+	//
+	// +checklocks:lastErrorMu
+	lastError tcpip.Error
+
+	// writeDiagnosticsMu protects the diagnostics recorded for writes while
+	// WriteDiagnosticsOption is enabled. It has a dedicated mutex as they are
+	// recorded while mu is only read locked.
+	writeDiagnosticsMu sync.Mutex `state:"nosave"`
+	// +checklocks:writeDiagnosticsMu
+	lastWriteError WriteError `state:"nosave"`
+	// +checklocks:writeDiagnosticsMu
+	lastTTLSource TTLSource `state:"nosave"`
+
+	// routeCache caches routes found for unconnected writes. It is not saved as
+	// routes are not saved; it is refilled by writes after restore.
+	routeCache routeCache `state:"nosave"`
 
 	// Lock ordering: mu > infoMu.
 	infoMu sync.RWMutex `state:"nosave"`
@@ -100,6 +191,15 @@ type Endpoint struct {
 	// Writes must be performed through setEndpointState.
 	state atomicbitops.Uint32
 
+	// netProto holds the tcpip.NetworkProtocolNumber the endpoint was
+	// initialized with. It only changes when a connected IPv6 endpoint is
+	// converted to IPv4 (see IPv6AddrFormOption).
+	//
+	// netProto must be accessed with atomics for the same reasons as state.
+	//
+	// Writes must be performed while holding mu.
+	netProto atomicbitops.Uint32
+
 	// Callers should not attempt to obtain sendBufferSizeInUseMu while holding
 	// another lock on Endpoint.
 	sendBufferSizeInUseMu sync.RWMutex `state:"nosave"`
@@ -109,6 +209,14 @@ type Endpoint struct {
 	sendBufferSizeInUse int64 `state:"nosave"`
 }
 
+// multicastMembership identifies a multicast group joined on an interface.
+//
+// Memberships are per interface, as in Linux: the same group may be joined on
+// several interfaces and each membership is added and removed independently.
+// Joining a group again on the same interface fails with ErrPortInUse
+// (EADDRINUSE) and removing a group that was not joined on the interface fails
+// with ErrBadLocalAddress (EADDRNOTAVAIL).
+//
 // +stateify savable
 type multicastMembership struct {
 	nicID         tcpip.NICID
@@ -131,7 +239,7 @@ func (e *Endpoint) Init(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, tr
 
 	e.stack = s
 	e.ops = ops
-	e.netProto = netProto
+	e.netProto.Store(uint32(netProto))
 	e.transProto = transProto
 	e.waiterQueue = waiterQueue
 	e.infoMu.Lock()
@@ -146,13 +254,15 @@ func (e *Endpoint) Init(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, tr
 
 	// Linux defaults to TTL=1.
 	e.multicastTTL = 1
+	// Linux defaults to IP_MULTICAST_ALL=1.
+	e.multicastAll = true
 	e.multicastMemberships = make(map[multicastMembership]struct{})
 	e.setEndpointState(transport.DatagramEndpointStateInitial)
 }
 
 // NetProto returns the network protocol the endpoint was initialized with.
 func (e *Endpoint) NetProto() tcpip.NetworkProtocolNumber {
-	return e.netProto
+	return tcpip.NetworkProtocolNumber(e.netProto.Load())
 }
 
 // setEndpointState sets the state of the endpoint.
@@ -181,54 +291,220 @@ func (e *Endpoint) Close() {
 	}
 
 	for mem := range e.multicastMemberships {
-		e.stack.LeaveGroup(e.netProto, mem.nicID, mem.multicastAddr)
+		e.stack.LeaveGroup(e.NetProto(), mem.nicID, mem.multicastAddr)
 	}
 	e.multicastMemberships = nil
 
+	// Outstanding write contexts hold their own route references so releasing
+	// the endpoint's references here does not affect in-flight writes.
 	if e.connectedRoute != nil {
 		e.connectedRoute.Release()
 		e.connectedRoute = nil
 	}
+	e.pathMTU = 0
+
+	e.routeCache.trim(0)
 
 	e.setEndpointState(transport.DatagramEndpointStateClosed)
 }
 
+// Reset clears the state of a closed endpoint so that it may be reused by
+// calling Init again, e.g. when endpoints are pooled.
+//
+// Packets that are still in flight continue to be accounted against the
+// endpoint's send buffer.
+//
+// Precondition: the endpoint must be closed.
+func (e *Endpoint) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if state := e.State(); state != transport.DatagramEndpointStateClosed {
+		panic(fmt.Sprintf("endpoint must be closed before being reset; got state = %s", state))
+	}
+	if e.multicastMemberships != nil || e.connectedRoute != nil {
+		panic(fmt.Sprintf("closed endpoint holds resources; got e.multicastMemberships = %#v, e.connectedRoute = %#v", e.multicastMemberships, e.connectedRoute))
+	}
+
+	e.stack = nil
+	e.wasBound = false
+	e.boundNICID = 0
+	e.owner = nil
+	e.readShutdown = false
+	e.writeShutdown = false
+	e.effectiveNetProto = 0
+	e.ipv4TTL = 0
+	e.ipv6HopLimit = 0
+	e.defaultTTL = 0
+	e.multicastTTL = 0
+	e.multicastAddr = tcpip.Address{}
+	e.multicastNICID = 0
+	e.ipv4UnicastNICID = 0
+	e.ipv6UnicastNICID = 0
+	e.multicastAll = false
+	e.multicastLoopStrict = false
+	e.ipv4TOS = 0
+	e.ipv6TClass = 0
+	e.ecn = 0
+	e.routeCacheSize = 0
+	e.writeDiagnostics = false
+	e.floatingSource = false
+	e.broadcastUnrestricted = false
+	e.preferredSource = tcpip.Address{}
+	e.pathMTU = 0
+	e.mtuChangeHandler = nil
+	e.lastErrorMu.Lock()
+	e.lastError = nil
+	e.lastErrorMu.Unlock()
+	e.writeDiagnosticsMu.Lock()
+	e.lastWriteError = WriteError{}
+	e.lastTTLSource = TTLSourceNone
+	e.writeDiagnosticsMu.Unlock()
+	e.setInfo(stack.TransportEndpointInfo{})
+}
+
+// Clone initializes n as a new endpoint on e's stack with e's network and
+// transport protocols and copies e's sticky options to it, including its
+// multicast memberships which n joins independently. n is not bound or
+// connected.
+//
+// If joining a multicast group fails, n leaves the groups it already joined,
+// is closed and the error is returned.
+func (e *Endpoint) Clone(n *Endpoint, ops *tcpip.SocketOptions, waiterQueue *waiter.Queue) tcpip.Error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.State() == transport.DatagramEndpointStateClosed {
+		return &tcpip.ErrInvalidEndpointState{}
+	}
+
+	netProto := e.NetProto()
+	n.Init(e.stack, netProto, e.transProto, ops, waiterQueue)
+
+	n.mu.Lock()
+	n.ipv4TTL = e.ipv4TTL
+	n.ipv6HopLimit = e.ipv6HopLimit
+	n.defaultTTL = e.defaultTTL
+	n.multicastTTL = e.multicastTTL
+	n.multicastAddr = e.multicastAddr
+	n.multicastNICID = e.multicastNICID
+	n.ipv4UnicastNICID = e.ipv4UnicastNICID
+	n.ipv6UnicastNICID = e.ipv6UnicastNICID
+	n.multicastAll = e.multicastAll
+	n.multicastLoopStrict = e.multicastLoopStrict
+	n.ipv4TOS = e.ipv4TOS
+	n.ipv6TClass = e.ipv6TClass
+	n.ecn = e.ecn
+	n.routeCacheSize = e.routeCacheSize
+	n.writeDiagnostics = e.writeDiagnostics
+	n.floatingSource = e.floatingSource
+	n.broadcastUnrestricted = e.broadcastUnrestricted
+	n.preferredSource = e.preferredSource
+	for mem := range e.multicastMemberships {
+		if err := n.stack.JoinGroup(netProto, mem.nicID, mem.multicastAddr); err != nil {
+			n.mu.Unlock()
+			n.Close()
+			return err
+		}
+		n.multicastMemberships[mem] = struct{}{}
+	}
+	n.mu.Unlock()
+	return nil
+}
+
 // SetOwner sets the owner of transmitted packets.
+//
+// The owner is captured along with the route when a WriteContext is acquired
+// so packets written through a context acquired after SetOwner returns carry
+// the new owner, while contexts acquired earlier keep the previous owner.
 func (e *Endpoint) SetOwner(owner tcpip.PacketOwner) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 	e.owner = owner
 }
 
+// GetOwner returns the owner of transmitted packets.
+func (e *Endpoint) GetOwner() tcpip.PacketOwner {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.owner
+}
+
+// calculateTTL returns the TTL (or hop limit) of packets sent through route
+// when the write does not carry its own.
+//
+// Packets to a multicast destination always use the multicast TTL. Otherwise
+// the TTL set with IPv4TTLOption or IPv6HopLimitOption is used if there is
+// one, then EndpointDefaultTTLOption if it is set, and finally the route's
+// default TTL.
+//
+// The source of the TTL is returned along with it.
+//
 // +checklocksread:e.mu
-func (e *Endpoint) calculateTTL(route *stack.Route) uint8 {
+func (e *Endpoint) calculateTTL(route *stack.Route) (uint8, TTLSource) {
 	remoteAddress := route.RemoteAddress()
 	if header.IsV4MulticastAddress(remoteAddress) || header.IsV6MulticastAddress(remoteAddress) {
-		return e.multicastTTL
+		return e.multicastTTL, TTLSourceMulticast
 	}
 
 	switch netProto := route.NetProto(); netProto {
 	case header.IPv4ProtocolNumber:
-		if e.ipv4TTL == 0 {
-			return route.DefaultTTL()
+		if e.ipv4TTL != 0 {
+			return e.ipv4TTL, TTLSourceExplicit
 		}
-		return e.ipv4TTL
 	case header.IPv6ProtocolNumber:
-		if e.ipv6HopLimit == -1 {
-			return route.DefaultTTL()
+		if e.ipv6HopLimit != -1 {
+			return uint8(e.ipv6HopLimit), TTLSourceExplicit
 		}
-		return uint8(e.ipv6HopLimit)
 	default:
 		panic(fmt.Sprintf("invalid protocol number = %d", netProto))
 	}
+
+	if e.defaultTTL != 0 {
+		return e.defaultTTL, TTLSourceEndpointDefault
+	}
+	return route.DefaultTTL(), TTLSourceRouteDefault
+}
+
+// ecnMask is the mask of the ECN field in the IPv4 TOS and IPv6 traffic class.
+const ecnMask = 0x3
+
+// applyECN returns tos with its ECN field set according to the ECNOption value
+// ecn. The DSCP field is left as is.
+func applyECN(tos uint8, ecn int) uint8 {
+	var codepoint uint8
+	switch ecn {
+	case tcpip.ECNFromTOS:
+		return tos
+	case tcpip.ECNNotECT:
+		codepoint = 0x0
+	case tcpip.ECNECT0:
+		codepoint = 0x2
+	case tcpip.ECNECT1:
+		codepoint = 0x1
+	default:
+		panic(fmt.Sprintf("invalid ECN policy = %d", ecn))
+	}
+	return tos&^ecnMask | codepoint
 }
 
 // WriteContext holds the context for a write.
+//
+// The context only covers the network layer. The caller builds the transport
+// header, including any ports, before calling WritePacket.
+//
+// The context holds its own reference on the route it writes through, acquired
+// while the endpoint's lock is held, so the endpoint may be closed while the
+// context is in use; the route remains valid until Release is called.
 type WriteContext struct {
 	e     *Endpoint
 	route *stack.Route
+	owner tcpip.PacketOwner
 	ttl   uint8
 	tos   uint8
+	df    bool
+	hasID bool
+	id    uint16
 }
 
 func (c *WriteContext) MTU() uint32 {
@@ -247,6 +523,13 @@ type WritePacketInfo struct {
 	LocalAddress, RemoteAddress tcpip.Address
 	MaxHeaderLength             uint16
 	RequiresTXTransportChecksum bool
+
+	// TTL is the TTL (IPv4) or hop limit (IPv6) the packet will be sent with,
+	// after the route's default has been applied if none was configured.
+	TTL uint8
+	// TOS is the TOS (IPv4) or traffic class (IPv6) the packet will be sent
+	// with.
+	TOS uint8
 }
 
 // PacketInfo returns the properties of a packet that will be written.
@@ -257,6 +540,8 @@ func (c *WriteContext) PacketInfo() WritePacketInfo {
 		RemoteAddress:               c.route.RemoteAddress(),
 		MaxHeaderLength:             c.route.MaxHeaderLength(),
 		RequiresTXTransportChecksum: c.route.RequiresTXTransportChecksum(),
+		TTL:                         c.ttl,
+		TOS:                         c.tos,
 	}
 }
 
@@ -309,9 +594,7 @@ func (c *WriteContext) TryNewPacketBuffer(reserveHdrBytes int, data buffer.Buffe
 
 // WritePacket attempts to write the packet.
 func (c *WriteContext) WritePacket(pkt stack.PacketBufferPtr, headerIncluded bool) tcpip.Error {
-	c.e.mu.RLock()
-	pkt.Owner = c.e.owner
-	c.e.mu.RUnlock()
+	pkt.Owner = c.owner
 
 	if headerIncluded {
 		return c.route.WriteHeaderIncludedPacket(pkt)
@@ -321,6 +604,9 @@ func (c *WriteContext) WritePacket(pkt stack.PacketBufferPtr, headerIncluded boo
 		Protocol: c.e.transProto,
 		TTL:      c.ttl,
 		TOS:      c.tos,
+		DF:       c.df,
+		HasID:    c.hasID,
+		ID:       c.id,
 	}, pkt)
 
 	if _, ok := err.(*tcpip.ErrNoBufferSpace); ok {
@@ -346,6 +632,22 @@ func (c *WriteContext) WritePacket(pkt stack.PacketBufferPtr, headerIncluded boo
 	return err
 }
 
+// WritePackets writes pkts in order as if by WritePacket, stopping at the first
+// packet that fails to be written. It returns the number of packets written
+// and the error the failing packet was written with.
+//
+// All packets are written through the context's route so a burst of packets,
+// e.g. from a connected endpoint, requires a single route lookup and endpoint
+// state check. The caller retains ownership of pkts.
+func (c *WriteContext) WritePackets(pkts []stack.PacketBufferPtr, headerIncluded bool) (int, tcpip.Error) {
+	for i, pkt := range pkts {
+		if err := c.WritePacket(pkt, headerIncluded); err != nil {
+			return i, err
+		}
+	}
+	return len(pkts), nil
+}
+
 // MaybeSignalWritable signals waiters with writable events if the send buffer
 // has space.
 func (e *Endpoint) MaybeSignalWritable() {
@@ -370,17 +672,225 @@ func (e *Endpoint) hasSendSpaceRLocked() bool {
 	return e.ops.GetSendBufferSize() > e.sendBufferSizeInUse
 }
 
+// UpdateLastError sets the endpoint's last asynchronous error.
+func (e *Endpoint) UpdateLastError(err tcpip.Error) {
+	e.lastErrorMu.Lock()
+	defer e.lastErrorMu.Unlock()
+	e.lastError = err
+}
+
+// LastError returns and clears the endpoint's last asynchronous error.
+func (e *Endpoint) LastError() tcpip.Error {
+	e.lastErrorMu.Lock()
+	defer e.lastErrorMu.Unlock()
+	err := e.lastError
+	e.lastError = nil
+	return err
+}
+
+// HasLastError returns true iff the endpoint has an asynchronous error that
+// has not been read.
+func (e *Endpoint) HasLastError() bool {
+	e.lastErrorMu.Lock()
+	defer e.lastErrorMu.Unlock()
+	return e.lastError != nil
+}
+
+// WriteDropReason is the reason a write was rejected.
+type WriteDropReason int
+
+// The reasons a write may be rejected.
+const (
+	// WriteDropNone indicates that no write was rejected.
+	WriteDropNone WriteDropReason = iota
+	// WriteDropClosed indicates that the endpoint was closed.
+	WriteDropClosed
+	// WriteDropShutdown indicates that the endpoint was shut down for writing.
+	WriteDropShutdown
+	// WriteDropDestinationRequired indicates that no destination was specified
+	// for an unconnected endpoint.
+	WriteDropDestinationRequired
+	// WriteDropAddressFamily indicates that the destination's address family is
+	// not supported by the endpoint.
+	WriteDropAddressFamily
+	// WriteDropBroadcastDisabled indicates that the destination was a broadcast
+	// address and SO_BROADCAST was not set.
+	WriteDropBroadcastDisabled
+	// WriteDropNoRoute indicates that no route to the destination was found.
+	WriteDropNoRoute
+	// WriteDropBadLocalAddress indicates that the requested local address
+	// could not be used.
+	WriteDropBadLocalAddress
+	// WriteDropOther indicates any other reason.
+	WriteDropOther
+)
+
+// String implements fmt.Stringer.
+func (r WriteDropReason) String() string {
+	switch r {
+	case WriteDropNone:
+		return "NONE"
+	case WriteDropClosed:
+		return "CLOSED"
+	case WriteDropShutdown:
+		return "SHUTDOWN"
+	case WriteDropDestinationRequired:
+		return "DESTINATION REQUIRED"
+	case WriteDropAddressFamily:
+		return "ADDRESS FAMILY"
+	case WriteDropBroadcastDisabled:
+		return "BROADCAST DISABLED"
+	case WriteDropNoRoute:
+		return "NO ROUTE"
+	case WriteDropBadLocalAddress:
+		return "BAD LOCAL ADDRESS"
+	case WriteDropOther:
+		return "OTHER"
+	default:
+		panic(fmt.Sprintf("unhandled write drop reason = %d", int(r)))
+	}
+}
+
+// writeDropReason returns the reason a write rejected with err was rejected
+// for, for errors that only have one cause.
+func writeDropReason(err tcpip.Error) WriteDropReason {
+	switch err.(type) {
+	case *tcpip.ErrClosedForSend:
+		return WriteDropShutdown
+	case *tcpip.ErrDestinationRequired:
+		return WriteDropDestinationRequired
+	case *tcpip.ErrAddressFamilyNotSupported:
+		return WriteDropAddressFamily
+	case *tcpip.ErrBroadcastDisabled:
+		return WriteDropBroadcastDisabled
+	case *tcpip.ErrHostUnreachable, *tcpip.ErrNetworkUnreachable:
+		return WriteDropNoRoute
+	case *tcpip.ErrBadLocalAddress:
+		return WriteDropBadLocalAddress
+	default:
+		return WriteDropOther
+	}
+}
+
+// WriteError describes a rejected write.
+type WriteError struct {
+	// Reason is why the write was rejected.
+	Reason WriteDropReason
+
+	// Err is the error the write was rejected with.
+	Err tcpip.Error
+
+	// NIC is the interface the write was attempted through, or zero if the
+	// write was rejected before one was selected.
+	NIC tcpip.NICID
+
+	// RemoteAddress is the destination of the write, if known.
+	RemoteAddress tcpip.Address
+}
+
+// LastWriteError returns the last rejected write recorded while
+// WriteDiagnosticsOption was enabled. Its Reason is WriteDropNone if no
+// rejected write was recorded.
+func (e *Endpoint) LastWriteError() WriteError {
+	e.writeDiagnosticsMu.Lock()
+	defer e.writeDiagnosticsMu.Unlock()
+	return e.lastWriteError
+}
+
+// TTLSource is where the TTL (or hop limit) of a write came from.
+type TTLSource int
+
+// The sources of a write's TTL.
+const (
+	// TTLSourceNone indicates that no write was recorded.
+	TTLSourceNone TTLSource = iota
+	// TTLSourceControlMessage indicates that the TTL was carried by the write's
+	// control messages.
+	TTLSourceControlMessage
+	// TTLSourceExplicit indicates that the TTL was set with IPv4TTLOption or
+	// IPv6HopLimitOption.
+	TTLSourceExplicit
+	// TTLSourceMulticast indicates that the destination was a multicast address
+	// so the multicast TTL was used.
+	TTLSourceMulticast
+	// TTLSourceEndpointDefault indicates that the TTL was set with
+	// EndpointDefaultTTLOption.
+	TTLSourceEndpointDefault
+	// TTLSourceRouteDefault indicates that the route's default TTL was used.
+	TTLSourceRouteDefault
+)
+
+// String implements fmt.Stringer.
+func (s TTLSource) String() string {
+	switch s {
+	case TTLSourceNone:
+		return "NONE"
+	case TTLSourceControlMessage:
+		return "CONTROL MESSAGE"
+	case TTLSourceExplicit:
+		return "EXPLICIT"
+	case TTLSourceMulticast:
+		return "MULTICAST"
+	case TTLSourceEndpointDefault:
+		return "ENDPOINT DEFAULT"
+	case TTLSourceRouteDefault:
+		return "ROUTE DEFAULT"
+	default:
+		panic(fmt.Sprintf("unhandled TTL source = %d", int(s)))
+	}
+}
+
+// LastTTLSource returns where the TTL of the last write context acquired while
+// WriteDiagnosticsOption was enabled came from. It is TTLSourceNone if no write
+// context was acquired.
+func (e *Endpoint) LastTTLSource() TTLSource {
+	e.writeDiagnosticsMu.Lock()
+	defer e.writeDiagnosticsMu.Unlock()
+	return e.lastTTLSource
+}
+
 // AcquireContextForWrite acquires a WriteContext.
-func (e *Endpoint) AcquireContextForWrite(opts tcpip.WriteOptions) (WriteContext, tcpip.Error) {
+//
+// If WriteDiagnosticsOption is enabled, a rejected write is recorded and may
+// be retrieved with LastWriteError, and the source of an accepted write's TTL
+// may be retrieved with LastTTLSource.
+func (e *Endpoint) AcquireContextForWrite(opts tcpip.WriteOptions) (ctx WriteContext, err tcpip.Error) {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
+	var writeErr WriteError
+	if e.writeDiagnostics {
+		if opts.To != nil {
+			writeErr.RemoteAddress = opts.To.Addr
+		}
+		defer func() {
+			if err == nil {
+				return
+			}
+			if writeErr.Reason == WriteDropNone {
+				writeErr.Reason = writeDropReason(err)
+			}
+			writeErr.Err = err
+			e.writeDiagnosticsMu.Lock()
+			e.lastWriteError = writeErr
+			e.writeDiagnosticsMu.Unlock()
+		}()
+	}
+
 	// MSG_MORE is unimplemented. This also means that MSG_EOR is a no-op.
 	if opts.More {
 		return WriteContext{}, &tcpip.ErrInvalidOptionValue{}
 	}
 
+	if opts.To != nil {
+		if err := e.checkDestinationFamily(opts.To.Addr); err != nil {
+			writeErr.Reason = WriteDropAddressFamily
+			return WriteContext{}, err
+		}
+	}
+
 	if e.State() == transport.DatagramEndpointStateClosed {
+		writeErr.Reason = WriteDropClosed
 		return WriteContext{}, &tcpip.ErrInvalidEndpointState{}
 	}
 
@@ -400,16 +910,19 @@ func (e *Endpoint) AcquireContextForWrite(opts tcpip.WriteOptions) (WriteContext
 		if e.State() != transport.DatagramEndpointStateConnected {
 			return WriteContext{}, &tcpip.ErrDestinationRequired{}
 		}
+		writeErr.NIC = route.NICID()
+		writeErr.RemoteAddress = route.RemoteAddress()
 
-		if !ipv6PktInfoValid {
+		if !ipv6PktInfoValid && !e.sourceFloatsRLocked() {
 			route.Acquire()
 			break
 		}
 
 		// We are connected and the caller did not specify the destination but
 		// we have an IPv6 packet info structure which may change our local
-		// interface/address used to send the packet so we need to construct
-		// a new route instead of using the connected route.
+		// interface/address used to send the packet, or the endpoint's source
+		// floats, so we need to construct a new route instead of using the
+		// connected route.
 		//
 		// Contruct a destination matching the remote the endpoint is connected
 		// to.
@@ -423,15 +936,20 @@ func (e *Endpoint) AcquireContextForWrite(opts tcpip.WriteOptions) (WriteContext
 		}
 		fallthrough
 	default:
-		// Reject destination address if it goes through a different
-		// NIC than the endpoint was bound to.
-		nicID := to.NIC
-		if nicID == 0 {
-			nicID = tcpip.NICID(e.ops.GetBindToDevice())
+		dst, netProto, err := e.checkV4Mapped(*to)
+		if err != nil {
+			return WriteContext{}, err
 		}
+		writeErr.RemoteAddress = dst.Addr
 
+		var nicID tcpip.NICID
 		var localAddr tcpip.Address
 		if ipv6PktInfoValid {
+			nicID, err = e.requestedNICRLocked(to.NIC, dst.Addr)
+			if err != nil {
+				return WriteContext{}, err
+			}
+
 			// Uphold strong-host semantics since (as of writing) the stack follows
 			// the strong host model.
 
@@ -477,63 +995,149 @@ func (e *Endpoint) AcquireContextForWrite(opts tcpip.WriteOptions) (WriteContext
 				localAddr = pktInfoAddr
 			}
 		} else {
-			if info.BindNICID != 0 {
-				if nicID != 0 && nicID != info.BindNICID {
-					return WriteContext{}, &tcpip.ErrHostUnreachable{}
-				}
-
-				nicID = info.BindNICID
-			}
-			if nicID == 0 {
-				nicID = info.RegisterNICID
+			nicID, err = e.writeNICRLocked(to.NIC, dst.Addr, info)
+			if err != nil {
+				return WriteContext{}, err
 			}
 		}
+		writeErr.NIC = nicID
 
-		dst, netProto, err := e.checkV4Mapped(*to)
-		if err != nil {
-			return WriteContext{}, err
+		// Reject limited broadcasts before looking up a route so that the error
+		// does not depend on whether one exists.
+		if dst.Addr == header.IPv4Broadcast && !e.broadcastAllowedRLocked() {
+			return WriteContext{}, &tcpip.ErrBroadcastDisabled{}
 		}
 
-		route, _, err = e.connectRouteRLocked(nicID, localAddr, dst, netProto)
+		route, _, err = e.connectRouteRLocked(nicID, localAddr, dst, netProto, true /* cached */)
 		if err != nil {
 			return WriteContext{}, err
 		}
 	}
 
-	if !e.ops.GetBroadcast() && route.IsOutboundBroadcast() {
+	writeErr.NIC = route.NICID()
+
+	if !e.broadcastAllowedRLocked() && route.IsOutboundBroadcast() {
 		route.Release()
 		return WriteContext{}, &tcpip.ErrBroadcastDisabled{}
 	}
 
+	if e.multicastLoopStrict && !e.ops.GetMulticastLoop() && route.IsOutgoingNICLoopback() {
+		if remoteAddr := route.RemoteAddress(); header.IsV4MulticastAddress(remoteAddr) || header.IsV6MulticastAddress(remoteAddr) {
+			route.Release()
+			return WriteContext{}, &tcpip.ErrNotSupported{}
+		}
+	}
+
+	// Only IPv4 headers have an identification field.
+	if opts.HasIPv4ID && route.NetProto() != header.IPv4ProtocolNumber {
+		route.Release()
+		return WriteContext{}, &tcpip.ErrInvalidOptionValue{}
+	}
+
 	var tos uint8
 	var ttl uint8
+	var ttlSource TTLSource
 	switch netProto := route.NetProto(); netProto {
 	case header.IPv4ProtocolNumber:
 		tos = e.ipv4TOS
 		if opts.ControlMessages.HasTTL {
-			ttl = opts.ControlMessages.TTL
+			ttl, ttlSource = opts.ControlMessages.TTL, TTLSourceControlMessage
 		} else {
-			ttl = e.calculateTTL(route)
+			ttl, ttlSource = e.calculateTTL(route)
 		}
 	case header.IPv6ProtocolNumber:
 		tos = e.ipv6TClass
+		if opts.ControlMessages.HasTClass {
+			tos = opts.ControlMessages.TClass
+		}
 		if opts.ControlMessages.HasHopLimit {
-			ttl = opts.ControlMessages.HopLimit
+			ttl, ttlSource = opts.ControlMessages.HopLimit, TTLSourceControlMessage
 		} else {
-			ttl = e.calculateTTL(route)
+			ttl, ttlSource = e.calculateTTL(route)
 		}
 	default:
 		panic(fmt.Sprintf("invalid protocol number = %d", netProto))
 	}
+	tos = applyECN(tos, e.ecn)
+
+	if e.writeDiagnostics {
+		e.writeDiagnosticsMu.Lock()
+		e.lastTTLSource = ttlSource
+		e.writeDiagnosticsMu.Unlock()
+	}
 
 	return WriteContext{
 		e:     e,
 		route: route,
+		owner: e.owner,
 		ttl:   ttl,
 		tos:   tos,
+		df:    opts.DontFragment,
+		hasID: opts.HasIPv4ID,
+		id:    opts.IPv4ID,
 	}, nil
 }
 
+// requestedNICRLocked returns the NIC a write to dst was explicitly requested
+// to egress: toNIC, the NIC of the destination address, or else the device the
+// endpoint is bound to. Zero is returned if neither is set.
+//
+// As on Linux, the bound device takes precedence over the multicast interface
+// when the destination does not specify an interface. Rather than silently
+// ignoring a multicast interface that names another interface, multicast
+// writes fail with ErrHostUnreachable (see writeNICRLocked).
+//
+// +checklocksread:e.mu
+func (e *Endpoint) requestedNICRLocked(toNIC tcpip.NICID, dst tcpip.Address) (tcpip.NICID, tcpip.Error) {
+	if toNIC != 0 {
+		return toNIC, nil
+	}
+	device := tcpip.NICID(e.ops.GetBindToDevice())
+	if device != 0 && e.multicastNICID != 0 && e.multicastNICID != device {
+		if header.IsV4MulticastAddress(dst) || header.IsV6MulticastAddress(dst) {
+			return 0, &tcpip.ErrHostUnreachable{}
+		}
+	}
+	return device, nil
+}
+
+// writeNICRLocked returns the NIC a write to dst must egress when the write
+// does not carry IPv6 packet info, or zero if the route lookup may pick any
+// NIC.
+//
+// The NIC is selected in the following order of precedence:
+//
+//  1. toNIC, the NIC of the destination address (e.g. an IPv6 zone).
+//  2. The device the endpoint is bound to (SO_BINDTODEVICE).
+//  3. The NIC given explicitly when the endpoint was bound (info.BindNICID).
+//  4. The NIC the endpoint is registered on.
+//
+// Multicast writes for which no NIC is selected egress the multicast interface
+// (see connectRouteRLocked).
+//
+// Contradicting inputs fail the write with ErrHostUnreachable rather than one
+// of them silently winning, as no NIC satisfies all of them: a NIC given at
+// bind time that differs from the NIC selected by 1 or 2, or a multicast
+// interface that differs from the bound device.
+//
+// +checklocksread:e.mu
+func (e *Endpoint) writeNICRLocked(toNIC tcpip.NICID, dst tcpip.Address, info stack.TransportEndpointInfo) (tcpip.NICID, tcpip.Error) {
+	nicID, err := e.requestedNICRLocked(toNIC, dst)
+	if err != nil {
+		return 0, err
+	}
+	if info.BindNICID != 0 {
+		if nicID != 0 && nicID != info.BindNICID {
+			return 0, &tcpip.ErrHostUnreachable{}
+		}
+		return info.BindNICID, nil
+	}
+	if nicID == 0 {
+		nicID = info.RegisterNICID
+	}
+	return nicID, nil
+}
+
 // Disconnect disconnects the endpoint from its peer.
 func (e *Endpoint) Disconnect() {
 	e.mu.Lock()
@@ -558,14 +1162,19 @@ func (e *Endpoint) Disconnect() {
 
 	e.connectedRoute.Release()
 	e.connectedRoute = nil
+	e.pathMTU = 0
 }
 
 // connectRouteRLocked establishes a route to the specified interface or the
 // configured multicast interface if no interface is specified and the
 // specified address is a multicast address.
 //
+// If cached is true, the route may be served from (and is added to) the
+// endpoint's route cache when it is enabled.
+//
 // +checklocksread:e.mu
-func (e *Endpoint) connectRouteRLocked(nicID tcpip.NICID, localAddr tcpip.Address, addr tcpip.FullAddress, netProto tcpip.NetworkProtocolNumber) (*stack.Route, tcpip.NICID, tcpip.Error) {
+func (e *Endpoint) connectRouteRLocked(nicID tcpip.NICID, localAddr tcpip.Address, addr tcpip.FullAddress, netProto tcpip.NetworkProtocolNumber, cached bool) (*stack.Route, tcpip.NICID, tcpip.Error) {
+	isMulticast := header.IsV4MulticastAddress(addr.Addr) || header.IsV6MulticastAddress(addr.Addr)
 	if localAddr.BitLen() == 0 {
 		localAddr = e.Info().ID.LocalAddress
 		if e.isBroadcastOrMulticast(nicID, netProto, localAddr) {
@@ -573,7 +1182,7 @@ func (e *Endpoint) connectRouteRLocked(nicID tcpip.NICID, localAddr tcpip.Addres
 			localAddr = tcpip.Address{}
 		}
 
-		if header.IsV4MulticastAddress(addr.Addr) || header.IsV6MulticastAddress(addr.Addr) {
+		if isMulticast {
 			if nicID == 0 {
 				nicID = e.multicastNICID
 			}
@@ -583,14 +1192,86 @@ func (e *Endpoint) connectRouteRLocked(nicID tcpip.NICID, localAddr tcpip.Addres
 		}
 	}
 
+	// Interface-local and link-local scoped multicast addresses are only
+	// meaningful on the interface identified by the destination's zone so the
+	// zone must name a usable interface that the packet will egress.
+	scoped := addr.NIC != 0 && isScopedV6Multicast(addr.Addr)
+	if scoped && (nicID != addr.NIC || !e.stack.CheckNIC(addr.NIC)) {
+		return nil, 0, &tcpip.ErrNetworkUnreachable{}
+	}
+
+	// The unicast interface only selects the interface packets are sent from;
+	// unlike the multicast interface, it is not returned to the caller so the
+	// endpoint is not registered on it.
+	routeNICID := nicID
+	if routeNICID == 0 && !isMulticast {
+		switch netProto {
+		case header.IPv4ProtocolNumber:
+			routeNICID = e.ipv4UnicastNICID
+		case header.IPv6ProtocolNumber:
+			routeNICID = e.ipv6UnicastNICID
+		}
+	}
+
+	// Like Linux, limited broadcasts egress the interface holding the source
+	// address when no interface is specified so they do not require a route.
+	if routeNICID == 0 && addr.Addr == header.IPv4Broadcast && localAddr.BitLen() != 0 {
+		routeNICID = e.stack.CheckLocalAddress(0, netProto, localAddr)
+	}
+
 	// Find a route to the desired destination.
-	r, err := e.stack.FindRoute(nicID, localAddr, addr.Addr, netProto, e.ops.GetMulticastLoop())
+	cacheSize := 0
+	if cached {
+		cacheSize = e.routeCacheSize
+	}
+	r, err := e.routeCache.findRoute(e.stack, cacheSize, routeCacheKey{
+		nicID:         routeNICID,
+		localAddr:     localAddr,
+		remoteAddr:    addr.Addr,
+		netProto:      netProto,
+		multicastLoop: e.ops.GetMulticastLoop(),
+	})
 	if err != nil {
 		return nil, 0, err
 	}
+	if scoped && r.NICID() != addr.NIC {
+		r.Release()
+		return nil, 0, &tcpip.ErrNetworkUnreachable{}
+	}
+
+	// The preferred source address is only used if it is assigned to the
+	// interface the route egresses so it does not change how the packet is
+	// routed.
+	if pref := e.preferredSource; localAddr.BitLen() == 0 && pref.BitLen() != 0 && r.LocalAddress() != pref && e.stack.CheckLocalAddress(r.NICID(), netProto, pref) != 0 {
+		pr, err := e.routeCache.findRoute(e.stack, cacheSize, routeCacheKey{
+			nicID:         r.NICID(),
+			localAddr:     pref,
+			remoteAddr:    addr.Addr,
+			netProto:      netProto,
+			multicastLoop: e.ops.GetMulticastLoop(),
+		})
+		if err == nil {
+			r.Release()
+			r = pr
+		}
+	}
 	return r, nicID, nil
 }
 
+// isScopedV6Multicast returns true iff addr is an IPv6 multicast address with
+// interface-local or link-local scope.
+func isScopedV6Multicast(addr tcpip.Address) bool {
+	if !header.IsV6MulticastAddress(addr) {
+		return false
+	}
+	switch header.V6MulticastScope(addr) {
+	case header.IPv6InterfaceLocalMulticastScope, header.IPv6LinkLocalMulticastScope:
+		return true
+	default:
+		return false
+	}
+}
+
 // Connect connects the endpoint to the address.
 func (e *Endpoint) Connect(addr tcpip.FullAddress) tcpip.Error {
 	return e.ConnectAndThen(addr, func(_ tcpip.NetworkProtocolNumber, _, _ stack.TransportEndpointID) tcpip.Error {
@@ -605,6 +1286,12 @@ func (e *Endpoint) Connect(addr tcpip.FullAddress) tcpip.Error {
 // function will be called with the network protocol used to connect to the peer
 // and the source and destination addresses that will be used to send traffic to
 // the peer.
+//
+// If the endpoint is not bound, nextID.LocalAddress is the source address
+// selected for the peer by the route while previousID.LocalAddress is empty,
+// so the function may record the selected address or reject it by returning
+// an error. If FloatingSourceOption is enabled, nextID.LocalAddress is left
+// empty instead.
 func (e *Endpoint) ConnectAndThen(addr tcpip.FullAddress, f func(netProto tcpip.NetworkProtocolNumber, previousID, nextID stack.TransportEndpointID) tcpip.Error) tcpip.Error {
 	addr.Port = 0
 
@@ -634,7 +1321,7 @@ func (e *Endpoint) ConnectAndThen(addr tcpip.FullAddress, f func(netProto tcpip.
 		return err
 	}
 
-	r, nicID, err := e.connectRouteRLocked(nicID, tcpip.Address{}, addr, netProto)
+	r, nicID, err := e.connectRouteRLocked(nicID, tcpip.Address{}, addr, netProto, false /* cached */)
 	if err != nil {
 		return err
 	}
@@ -643,7 +1330,7 @@ func (e *Endpoint) ConnectAndThen(addr tcpip.FullAddress, f func(netProto tcpip.
 		LocalAddress:  info.ID.LocalAddress,
 		RemoteAddress: r.RemoteAddress(),
 	}
-	if e.State() == transport.DatagramEndpointStateInitial {
+	if e.State() == transport.DatagramEndpointStateInitial && !e.floatingSource {
 		id.LocalAddress = r.LocalAddress()
 	}
 
@@ -657,6 +1344,7 @@ func (e *Endpoint) ConnectAndThen(addr tcpip.FullAddress, f func(netProto tcpip.
 		e.connectedRoute.Release()
 	}
 	e.connectedRoute = r
+	e.pathMTU = r.MTU()
 	info.ID = id
 	info.RegisterNICID = nicID
 	e.setInfo(info)
@@ -665,8 +1353,12 @@ func (e *Endpoint) ConnectAndThen(addr tcpip.FullAddress, f func(netProto tcpip.
 	return nil
 }
 
-// Shutdown shutsdown the endpoint.
-func (e *Endpoint) Shutdown() tcpip.Error {
+// Shutdown shuts down the read and/or write sides of the endpoint.
+//
+// Only write shutdown affects the endpoint itself, which then rejects writes;
+// read shutdown is recorded for the transport endpoint, which owns the receive
+// path (see ShutdownFlags).
+func (e *Endpoint) Shutdown(flags tcpip.ShutdownFlags) tcpip.Error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
@@ -674,13 +1366,33 @@ func (e *Endpoint) Shutdown() tcpip.Error {
 	case transport.DatagramEndpointStateInitial, transport.DatagramEndpointStateClosed:
 		return &tcpip.ErrNotConnected{}
 	case transport.DatagramEndpointStateBound, transport.DatagramEndpointStateConnected:
-		e.writeShutdown = true
+		if flags&tcpip.ShutdownRead != 0 {
+			e.readShutdown = true
+		}
+		if flags&tcpip.ShutdownWrite != 0 {
+			e.writeShutdown = true
+		}
 		return nil
 	default:
 		panic(fmt.Sprintf("unhandled state = %s", state))
 	}
 }
 
+// ShutdownFlags returns the sides of the endpoint that have been shut down.
+func (e *Endpoint) ShutdownFlags() tcpip.ShutdownFlags {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var flags tcpip.ShutdownFlags
+	if e.readShutdown {
+		flags |= tcpip.ShutdownRead
+	}
+	if e.writeShutdown {
+		flags |= tcpip.ShutdownWrite
+	}
+	return flags
+}
+
 // checkV4MappedRLocked determines the effective network protocol and converts
 // addr to its canonical form.
 func (e *Endpoint) checkV4Mapped(addr tcpip.FullAddress) (tcpip.FullAddress, tcpip.NetworkProtocolNumber, tcpip.Error) {
@@ -692,6 +1404,27 @@ func (e *Endpoint) checkV4Mapped(addr tcpip.FullAddress) (tcpip.FullAddress, tcp
 	return unwrapped, netProto, nil
 }
 
+// checkDestinationFamily returns an error if addr is not a valid destination
+// for the endpoint's protocol, with the error Linux returns from sendto(2):
+// EAFNOSUPPORT for an IPv6 destination on an IPv4 endpoint and ENETUNREACH
+// for an IPv4 (or IPv4-mapped) destination on an IPv6-only endpoint.
+func (e *Endpoint) checkDestinationFamily(addr tcpip.Address) tcpip.Error {
+	switch e.NetProto() {
+	case header.IPv4ProtocolNumber:
+		if addr.BitLen() == header.IPv6AddressSizeBits {
+			return &tcpip.ErrAddressFamilyNotSupported{}
+		}
+	case header.IPv6ProtocolNumber:
+		if !e.ops.GetV6Only() {
+			return nil
+		}
+		if addr.BitLen() == header.IPv4AddressSizeBits || header.IsV4MappedAddress(addr) {
+			return &tcpip.ErrNetworkUnreachable{}
+		}
+	}
+	return nil
+}
+
 func (e *Endpoint) isBroadcastOrMulticast(nicID tcpip.NICID, netProto tcpip.NetworkProtocolNumber, addr tcpip.Address) bool {
 	return addr == header.IPv4Broadcast || header.IsV4MulticastAddress(addr) || header.IsV6MulticastAddress(addr) || e.stack.IsSubnetBroadcast(nicID, netProto, addr)
 }
@@ -725,6 +1458,14 @@ func (e *Endpoint) BindAndThen(addr tcpip.FullAddress, f func(tcpip.NetworkProto
 		return err
 	}
 
+	// Binding to the unspecified address of the endpoint's own family is the
+	// same as not specifying an address so that, e.g., a dual-stack endpoint
+	// bound to :: may still send to IPv4-mapped destinations unless V6Only is
+	// set.
+	if netProto == e.NetProto() && addr.Addr.Unspecified() {
+		addr.Addr = tcpip.Address{}
+	}
+
 	nicID := addr.NIC
 	if addr.Addr.BitLen() != 0 && !e.isBroadcastOrMulticast(addr.NIC, netProto, addr.Addr) {
 		nicID = e.stack.CheckLocalAddress(nicID, netProto, addr.Addr)
@@ -738,6 +1479,7 @@ func (e *Endpoint) BindAndThen(addr tcpip.FullAddress, f func(tcpip.NetworkProto
 	}
 
 	e.wasBound = true
+	e.boundNICID = addr.NIC
 
 	info := e.Info()
 	info.ID = stack.TransportEndpointID{
@@ -752,38 +1494,158 @@ func (e *Endpoint) BindAndThen(addr tcpip.FullAddress, f func(tcpip.NetworkProto
 	return nil
 }
 
-// WasBound returns true iff the endpoint was ever bound.
-func (e *Endpoint) WasBound() bool {
-	e.mu.RLock()
-	defer e.mu.RUnlock()
-	return e.wasBound
+// OnSetBindToDevice must be called before the endpoint's SO_BINDTODEVICE
+// option is changed to nicID.
+//
+// Subsequent sends from a bound endpoint are constrained to nicID; clearing the
+// device reverts to the NIC the endpoint was bound with, if any. Like Linux,
+// the device of a connected endpoint may also be changed, in which case the
+// connected route is resolved again through the new device.
+func (e *Endpoint) OnSetBindToDevice(nicID tcpip.NICID) tcpip.Error {
+	return e.OnSetBindToDeviceAndThen(nicID, func() tcpip.Error {
+		return nil
+	})
 }
 
-// GetLocalAddress returns the address that the endpoint is bound to.
-func (e *Endpoint) GetLocalAddress() tcpip.FullAddress {
-	e.mu.RLock()
-	defer e.mu.RUnlock()
+// OnSetBindToDeviceAndThen is like OnSetBindToDevice but calls the provided
+// function once the endpoint is ready to use the new device.
+//
+// If the function returns an error, the endpoint's state does not change. If
+// the endpoint is connected and its peer is not reachable through the new
+// device, ErrHostUnreachable is returned and the function is not called. The
+// connected route keeps its local address so an endpoint whose local address
+// is not assigned to the new device cannot reach its peer through it.
+func (e *Endpoint) OnSetBindToDeviceAndThen(nicID tcpip.NICID, f func() tcpip.Error) tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 
 	info := e.Info()
-	addr := info.BindAddr
-	if e.State() == transport.DatagramEndpointStateConnected {
-		addr = e.connectedRoute.LocalAddress()
+	info.BindNICID = nicID
+	if nicID == 0 {
+		info.BindNICID = e.boundNICID
 	}
 
-	return tcpip.FullAddress{
-		NIC:  info.RegisterNICID,
-		Addr: addr,
+	switch e.State() {
+	case transport.DatagramEndpointStateBound:
+		if err := f(); err != nil {
+			return err
+		}
+		e.setInfo(info)
+	case transport.DatagramEndpointStateConnected:
+		addr := tcpip.FullAddress{Addr: info.ID.RemoteAddress}
+		r, routeNICID, err := e.connectRouteRLocked(info.BindNICID, tcpip.Address{}, addr, e.effectiveNetProto, false /* cached */)
+		if err != nil {
+			return &tcpip.ErrHostUnreachable{}
+		}
+		if err := f(); err != nil {
+			r.Release()
+			return err
+		}
+		e.connectedRoute.Release()
+		e.connectedRoute = r
+		e.pathMTU = r.MTU()
+		info.RegisterNICID = routeNICID
+		e.setInfo(info)
+	default:
+		return f()
 	}
+	return nil
 }
 
-// GetRemoteAddress returns the address that the endpoint is connected to.
-func (e *Endpoint) GetRemoteAddress() (tcpip.FullAddress, bool) {
+// OnSetV6Only must be called before the endpoint's IPV6_V6ONLY option is
+// changed.
+//
+// The option determines whether IPv4-mapped addresses are accepted when the
+// endpoint is bound or connected, and so which network protocol the endpoint
+// effectively uses. Like Linux, the option may not be changed once the
+// endpoint is bound or connected as that would leave the endpoint registered
+// for a protocol the option no longer allows.
+func (e *Endpoint) OnSetV6Only() tcpip.Error {
 	e.mu.RLock()
 	defer e.mu.RUnlock()
 
-	if e.State() != transport.DatagramEndpointStateConnected {
-		return tcpip.FullAddress{}, false
-	}
+	switch e.State() {
+	case transport.DatagramEndpointStateBound, transport.DatagramEndpointStateConnected:
+		return &tcpip.ErrInvalidEndpointState{}
+	}
+	return nil
+}
+
+// SetMTUChangeHandler sets the function called with the new path MTU when the
+// path MTU of the connected endpoint is lowered. A nil f removes the handler.
+//
+// The handler is called without the endpoint's lock held so it may call back
+// into the endpoint.
+func (e *Endpoint) SetMTUChangeHandler(f func(mtu uint32)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.mtuChangeHandler = f
+}
+
+// PathMTU returns the MTU of the path to the connected peer, or zero if the
+// endpoint is not connected.
+//
+// The path MTU starts as the connected route's MTU and is only lowered by
+// packet too big errors (see HandlePacketTooBig); it is reset when the endpoint
+// connects again.
+func (e *Endpoint) PathMTU() uint32 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.pathMTU
+}
+
+// HandlePacketTooBig must be called when a packet too big error is received for
+// the endpoint. mtu is the network MTU of the link the packet was too big for.
+//
+// If the endpoint is connected and mtu is smaller than the path MTU, the path
+// MTU is lowered to mtu and the MTU change handler, if any, is called.
+func (e *Endpoint) HandlePacketTooBig(mtu uint32) {
+	e.mu.Lock()
+	if e.State() != transport.DatagramEndpointStateConnected || mtu == 0 || mtu >= e.pathMTU {
+		e.mu.Unlock()
+		return
+	}
+	e.pathMTU = mtu
+	f := e.mtuChangeHandler
+	e.mu.Unlock()
+
+	if f != nil {
+		f(mtu)
+	}
+}
+
+// WasBound returns true iff the endpoint was ever bound.
+func (e *Endpoint) WasBound() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.wasBound
+}
+
+// GetLocalAddress returns the address that the endpoint is bound to.
+func (e *Endpoint) GetLocalAddress() tcpip.FullAddress {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	info := e.Info()
+	addr := info.BindAddr
+	if e.State() == transport.DatagramEndpointStateConnected && !e.sourceFloatsRLocked() {
+		addr = e.connectedRoute.LocalAddress()
+	}
+
+	return tcpip.FullAddress{
+		NIC:  info.RegisterNICID,
+		Addr: addr,
+	}
+}
+
+// GetRemoteAddress returns the address that the endpoint is connected to.
+func (e *Endpoint) GetRemoteAddress() (tcpip.FullAddress, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.State() != transport.DatagramEndpointStateConnected {
+		return tcpip.FullAddress{}, false
+	}
 
 	return tcpip.FullAddress{
 		Addr: e.connectedRoute.RemoteAddress(),
@@ -791,6 +1653,19 @@ func (e *Endpoint) GetRemoteAddress() (tcpip.FullAddress, bool) {
 	}, true
 }
 
+// MaxHeaderLength returns the number of bytes that must be reserved for
+// headers below the transport layer in packets written to the connected peer
+// (see WritePacketInfo.MaxHeaderLength).
+func (e *Endpoint) MaxHeaderLength() (uint16, tcpip.Error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.State() != transport.DatagramEndpointStateConnected {
+		return 0, &tcpip.ErrNotConnected{}
+	}
+	return e.connectedRoute.MaxHeaderLength(), nil
+}
+
 // SetSockOptInt sets the socket option.
 func (e *Endpoint) SetSockOptInt(opt tcpip.SockOptInt, v int) tcpip.Error {
 	switch opt {
@@ -806,6 +1681,82 @@ func (e *Endpoint) SetSockOptInt(opt tcpip.SockOptInt, v int) tcpip.Error {
 		e.multicastTTL = uint8(v)
 		e.mu.Unlock()
 
+	case tcpip.MulticastAllOption:
+		if v != 0 && v != 1 {
+			return &tcpip.ErrInvalidOptionValue{}
+		}
+
+		e.mu.Lock()
+		e.multicastAll = v != 0
+		e.mu.Unlock()
+
+	case tcpip.IPv6AddrFormOption:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.setAddrFormLocked(tcpip.NetworkProtocolNumber(v))
+
+	case tcpip.UnicastInterfaceOption, tcpip.IPv6UnicastInterfaceOption:
+		if v < 0 {
+			return &tcpip.ErrInvalidOptionValue{}
+		}
+		nicID := tcpip.NICID(v)
+		if nicID != 0 && !e.stack.CheckNIC(nicID) {
+			return &tcpip.ErrBadLocalAddress{}
+		}
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		// Like Linux, an interface may not be set if the endpoint is bound to a
+		// device, except that IPv6 accepts the bound device itself.
+		if btd := tcpip.NICID(e.ops.GetBindToDevice()); nicID != 0 && btd != 0 {
+			if opt == tcpip.UnicastInterfaceOption || btd != nicID {
+				return &tcpip.ErrInvalidOptionValue{}
+			}
+		}
+		if opt == tcpip.UnicastInterfaceOption {
+			e.ipv4UnicastNICID = nicID
+		} else {
+			e.ipv6UnicastNICID = nicID
+		}
+
+	case tcpip.MulticastLoopStrictOption:
+		e.mu.Lock()
+		e.multicastLoopStrict = v != 0
+		e.mu.Unlock()
+
+	case tcpip.WriteDiagnosticsOption:
+		e.mu.Lock()
+		e.writeDiagnostics = v != 0
+		e.mu.Unlock()
+
+	case tcpip.FloatingSourceOption:
+		e.mu.Lock()
+		e.floatingSource = v != 0
+		e.mu.Unlock()
+
+	case tcpip.BroadcastUnrestrictedOption:
+		e.mu.Lock()
+		e.broadcastUnrestricted = v != 0
+		e.mu.Unlock()
+
+	case tcpip.RouteCacheSizeOption:
+		if v < 0 || v > maxRouteCacheSize {
+			return &tcpip.ErrInvalidOptionValue{}
+		}
+		e.mu.Lock()
+		e.routeCacheSize = v
+		e.routeCache.trim(v)
+		e.mu.Unlock()
+
+	case tcpip.EndpointDefaultTTLOption:
+		if v < 0 || v > math.MaxUint8 {
+			return &tcpip.ErrInvalidOptionValue{}
+		}
+		e.mu.Lock()
+		e.defaultTTL = uint8(v)
+		e.mu.Unlock()
+
 	case tcpip.IPv4TTLOption:
 		e.mu.Lock()
 		e.ipv4TTL = uint8(v)
@@ -816,17 +1767,71 @@ func (e *Endpoint) SetSockOptInt(opt tcpip.SockOptInt, v int) tcpip.Error {
 		e.ipv6HopLimit = int16(v)
 		e.mu.Unlock()
 
+	// The TOS and traffic class are stored as set, including the ECN bits.
+	// Unlike TCP, Linux does not reserve the ECN bits for the stack on datagram
+	// sockets so they are sent and read back unchanged.
 	case tcpip.IPv4TOSOption:
+		// Like Linux, only the low 8 bits of the value are kept.
 		e.mu.Lock()
 		e.ipv4TOS = uint8(v)
 		e.mu.Unlock()
 
 	case tcpip.IPv6TrafficClassOption:
+		if v < 0 || v > math.MaxUint8 {
+			return &tcpip.ErrInvalidOptionValue{}
+		}
 		e.mu.Lock()
 		e.ipv6TClass = uint8(v)
 		e.mu.Unlock()
+
+	case tcpip.ECNOption:
+		switch v {
+		case tcpip.ECNFromTOS, tcpip.ECNNotECT, tcpip.ECNECT0, tcpip.ECNECT1:
+		default:
+			return &tcpip.ErrInvalidOptionValue{}
+		}
+		e.mu.Lock()
+		e.ecn = v
+		e.mu.Unlock()
+	}
+
+	return nil
+}
+
+// setAddrFormLocked converts a connected IPv6 endpoint whose peer is an
+// IPv4-mapped address to an IPv4 endpoint.
+//
+// +checklocks:e.mu
+func (e *Endpoint) setAddrFormLocked(netProto tcpip.NetworkProtocolNumber) tcpip.Error {
+	// Linux only supports IPV6_ADDRFORM on UDP and TCP sockets.
+	if e.NetProto() != header.IPv6ProtocolNumber || e.transProto != header.UDPProtocolNumber {
+		return &tcpip.ErrUnknownProtocolOption{}
+	}
+	if netProto != header.IPv4ProtocolNumber {
+		return &tcpip.ErrInvalidOptionValue{}
+	}
+	if e.State() != transport.DatagramEndpointStateConnected {
+		return &tcpip.ErrNotConnected{}
+	}
+	if e.ops.GetV6Only() || e.effectiveNetProto != header.IPv4ProtocolNumber {
+		return &tcpip.ErrBadLocalAddress{}
+	}
+
+	// As per Linux, IPv6 multicast state does not survive the conversion.
+	for mem := range e.multicastMemberships {
+		e.stack.LeaveGroup(header.IPv6ProtocolNumber, mem.nicID, mem.multicastAddr)
+	}
+	e.multicastMemberships = make(map[multicastMembership]struct{})
+	if e.multicastAddr.Len() == header.IPv6AddressSize {
+		e.multicastAddr = tcpip.Address{}
 	}
 
+	// The endpoint's addresses are already stored in their IPv4 form as the
+	// endpoint is connected to an IPv4-mapped address.
+	e.netProto.Store(uint32(header.IPv4ProtocolNumber))
+	info := e.Info()
+	info.NetProto = header.IPv4ProtocolNumber
+	e.setInfo(info)
 	return nil
 }
 
@@ -843,6 +1848,78 @@ func (e *Endpoint) GetSockOptInt(opt tcpip.SockOptInt) (int, tcpip.Error) {
 		e.mu.Unlock()
 		return v, nil
 
+	case tcpip.MulticastAllOption:
+		e.mu.RLock()
+		v := 0
+		if e.multicastAll {
+			v = 1
+		}
+		e.mu.RUnlock()
+		return v, nil
+
+	case tcpip.IPv6AddrFormOption:
+		return int(e.NetProto()), nil
+
+	case tcpip.UnicastInterfaceOption:
+		e.mu.RLock()
+		v := int(e.ipv4UnicastNICID)
+		e.mu.RUnlock()
+		return v, nil
+
+	case tcpip.IPv6UnicastInterfaceOption:
+		e.mu.RLock()
+		v := int(e.ipv6UnicastNICID)
+		e.mu.RUnlock()
+		return v, nil
+
+	case tcpip.MulticastLoopStrictOption:
+		e.mu.RLock()
+		v := 0
+		if e.multicastLoopStrict {
+			v = 1
+		}
+		e.mu.RUnlock()
+		return v, nil
+
+	case tcpip.WriteDiagnosticsOption:
+		e.mu.RLock()
+		v := 0
+		if e.writeDiagnostics {
+			v = 1
+		}
+		e.mu.RUnlock()
+		return v, nil
+
+	case tcpip.FloatingSourceOption:
+		e.mu.RLock()
+		v := 0
+		if e.floatingSource {
+			v = 1
+		}
+		e.mu.RUnlock()
+		return v, nil
+
+	case tcpip.BroadcastUnrestrictedOption:
+		e.mu.RLock()
+		v := 0
+		if e.broadcastUnrestricted {
+			v = 1
+		}
+		e.mu.RUnlock()
+		return v, nil
+
+	case tcpip.RouteCacheSizeOption:
+		e.mu.RLock()
+		v := e.routeCacheSize
+		e.mu.RUnlock()
+		return v, nil
+
+	case tcpip.EndpointDefaultTTLOption:
+		e.mu.RLock()
+		v := int(e.defaultTTL)
+		e.mu.RUnlock()
+		return v, nil
+
 	case tcpip.IPv4TTLOption:
 		e.mu.Lock()
 		v := int(e.ipv4TTL)
@@ -867,6 +1944,12 @@ func (e *Endpoint) GetSockOptInt(opt tcpip.SockOptInt) (int, tcpip.Error) {
 		e.mu.RUnlock()
 		return v, nil
 
+	case tcpip.ECNOption:
+		e.mu.RLock()
+		v := e.ecn
+		e.mu.RUnlock()
+		return v, nil
+
 	default:
 		return -1, &tcpip.ErrUnknownProtocolOption{}
 	}
@@ -879,6 +1962,16 @@ func (e *Endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 		e.mu.Lock()
 		defer e.mu.Unlock()
 
+		// Resetting the multicast interface always succeeds, whatever the
+		// address family of the unspecified address or the NIC the endpoint is
+		// bound to, and reverts multicast sends to automatic interface
+		// selection.
+		if v.NIC == 0 && v.InterfaceAddr.Unspecified() {
+			e.multicastAddr = tcpip.Address{}
+			e.multicastNICID = 0
+			break
+		}
+
 		fa := tcpip.FullAddress{Addr: v.InterfaceAddr}
 		fa, netProto, err := e.checkV4Mapped(fa)
 		if err != nil {
@@ -887,12 +1980,6 @@ func (e *Endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 		nic := v.NIC
 		addr := fa.Addr
 
-		if nic == 0 && addr == (tcpip.Address{}) {
-			e.multicastAddr = tcpip.Address{}
-			e.multicastNICID = 0
-			break
-		}
-
 		if nic != 0 {
 			if !e.stack.CheckNIC(nic) {
 				return &tcpip.ErrBadLocalAddress{}
@@ -912,75 +1999,111 @@ func (e *Endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 		e.multicastAddr = addr
 
 	case *tcpip.AddMembershipOption:
-		if !(header.IsV4MulticastAddress(v.MulticastAddr) && e.netProto == header.IPv4ProtocolNumber) && !(header.IsV6MulticastAddress(v.MulticastAddr) && e.netProto == header.IPv6ProtocolNumber) {
-			return &tcpip.ErrInvalidOptionValue{}
+		mem, err := e.resolveMembership(tcpip.MembershipOption(*v))
+		if err != nil {
+			return err
 		}
 
-		nicID := v.NIC
+		e.mu.Lock()
+		defer e.mu.Unlock()
 
-		if v.InterfaceAddr.Unspecified() {
-			if nicID == 0 {
-				if r, err := e.stack.FindRoute(0, tcpip.Address{}, v.MulticastAddr, e.netProto, false /* multicastLoop */); err == nil {
-					nicID = r.NICID()
-					r.Release()
-				}
-			}
-		} else {
-			nicID = e.stack.CheckLocalAddress(nicID, e.netProto, v.InterfaceAddr)
+		// Only a duplicate membership on the same interface conflicts; see
+		// multicastMembership.
+		if _, ok := e.multicastMemberships[mem]; ok {
+			return &tcpip.ErrPortInUse{}
 		}
-		if nicID == 0 {
-			return &tcpip.ErrUnknownDevice{}
+
+		if err := e.stack.JoinGroup(e.NetProto(), mem.nicID, mem.multicastAddr); err != nil {
+			return err
 		}
 
-		memToInsert := multicastMembership{nicID: nicID, multicastAddr: v.MulticastAddr}
+		e.multicastMemberships[mem] = struct{}{}
+
+	case *tcpip.RemoveMembershipOption:
+		mem, err := e.resolveMembership(tcpip.MembershipOption(*v))
+		if err != nil {
+			return err
+		}
 
 		e.mu.Lock()
 		defer e.mu.Unlock()
 
-		if _, ok := e.multicastMemberships[memToInsert]; ok {
-			return &tcpip.ErrPortInUse{}
+		if _, ok := e.multicastMemberships[mem]; !ok {
+			return &tcpip.ErrBadLocalAddress{}
 		}
 
-		if err := e.stack.JoinGroup(e.netProto, nicID, v.MulticastAddr); err != nil {
+		if err := e.stack.LeaveGroup(e.NetProto(), mem.nicID, mem.multicastAddr); err != nil {
 			return err
 		}
 
-		e.multicastMemberships[memToInsert] = struct{}{}
+		delete(e.multicastMemberships, mem)
 
-	case *tcpip.RemoveMembershipOption:
-		if !(header.IsV4MulticastAddress(v.MulticastAddr) && e.netProto == header.IPv4ProtocolNumber) && !(header.IsV6MulticastAddress(v.MulticastAddr) && e.netProto == header.IPv6ProtocolNumber) {
-			return &tcpip.ErrInvalidOptionValue{}
+	case *tcpip.AddMembershipsOption:
+		mems, err := e.resolveMemberships(*v)
+		if err != nil {
+			return err
 		}
 
-		nicID := v.NIC
-		if v.InterfaceAddr.Unspecified() {
-			if nicID == 0 {
-				if r, err := e.stack.FindRoute(0, tcpip.Address{}, v.MulticastAddr, e.netProto, false /* multicastLoop */); err == nil {
-					nicID = r.NICID()
-					r.Release()
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		for _, mem := range mems {
+			if _, ok := e.multicastMemberships[mem]; ok {
+				return &tcpip.ErrPortInUse{}
+			}
+		}
+
+		netProto := e.NetProto()
+		for i, mem := range mems {
+			if err := e.stack.JoinGroup(netProto, mem.nicID, mem.multicastAddr); err != nil {
+				for _, joined := range mems[:i] {
+					e.stack.LeaveGroup(netProto, joined.nicID, joined.multicastAddr)
 				}
+				return err
 			}
-		} else {
-			nicID = e.stack.CheckLocalAddress(nicID, e.netProto, v.InterfaceAddr)
 		}
-		if nicID == 0 {
-			return &tcpip.ErrUnknownDevice{}
+		for _, mem := range mems {
+			e.multicastMemberships[mem] = struct{}{}
 		}
 
-		memToRemove := multicastMembership{nicID: nicID, multicastAddr: v.MulticastAddr}
+	case *tcpip.RemoveMembershipsOption:
+		mems, err := e.resolveMemberships(*v)
+		if err != nil {
+			return err
+		}
 
 		e.mu.Lock()
 		defer e.mu.Unlock()
 
-		if _, ok := e.multicastMemberships[memToRemove]; !ok {
-			return &tcpip.ErrBadLocalAddress{}
+		for _, mem := range mems {
+			if _, ok := e.multicastMemberships[mem]; !ok {
+				return &tcpip.ErrBadLocalAddress{}
+			}
 		}
 
-		if err := e.stack.LeaveGroup(e.netProto, nicID, v.MulticastAddr); err != nil {
-			return err
+		netProto := e.NetProto()
+		for i, mem := range mems {
+			if err := e.stack.LeaveGroup(netProto, mem.nicID, mem.multicastAddr); err != nil {
+				for _, left := range mems[:i] {
+					e.stack.JoinGroup(netProto, left.nicID, left.multicastAddr)
+				}
+				return err
+			}
+		}
+		for _, mem := range mems {
+			delete(e.multicastMemberships, mem)
 		}
 
-		delete(e.multicastMemberships, memToRemove)
+	case *tcpip.PreferredSourceOption:
+		addr := tcpip.Address(*v)
+		if addr.Unspecified() {
+			addr = tcpip.Address{}
+		} else if e.isBroadcastOrMulticast(0, e.NetProto(), addr) || e.stack.CheckLocalAddress(0, e.NetProto(), addr) == 0 {
+			return &tcpip.ErrBadLocalAddress{}
+		}
+		e.mu.Lock()
+		e.preferredSource = addr
+		e.mu.Unlock()
 
 	case *tcpip.SocketDetachFilterOption:
 		return nil
@@ -988,6 +2111,51 @@ func (e *Endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 	return nil
 }
 
+// resolveMembership returns the membership identified by v, resolving the
+// interface it applies to.
+func (e *Endpoint) resolveMembership(v tcpip.MembershipOption) (multicastMembership, tcpip.Error) {
+	netProto := e.NetProto()
+	if !(header.IsV4MulticastAddress(v.MulticastAddr) && netProto == header.IPv4ProtocolNumber) && !(header.IsV6MulticastAddress(v.MulticastAddr) && netProto == header.IPv6ProtocolNumber) {
+		return multicastMembership{}, &tcpip.ErrInvalidOptionValue{}
+	}
+
+	nicID := v.NIC
+	if v.InterfaceAddr.Unspecified() {
+		if nicID == 0 {
+			if r, err := e.stack.FindRoute(0, tcpip.Address{}, v.MulticastAddr, netProto, false /* multicastLoop */); err == nil {
+				nicID = r.NICID()
+				r.Release()
+			}
+		}
+	} else {
+		nicID = e.stack.CheckLocalAddress(nicID, netProto, v.InterfaceAddr)
+	}
+	if nicID == 0 {
+		return multicastMembership{}, &tcpip.ErrUnknownDevice{}
+	}
+
+	return multicastMembership{nicID: nicID, multicastAddr: v.MulticastAddr}, nil
+}
+
+// resolveMemberships resolves each of opts with resolveMembership. Identifying
+// the same membership more than once is invalid.
+func (e *Endpoint) resolveMemberships(opts []tcpip.MembershipOption) ([]multicastMembership, tcpip.Error) {
+	mems := make([]multicastMembership, 0, len(opts))
+	seen := make(map[multicastMembership]struct{}, len(opts))
+	for _, opt := range opts {
+		mem, err := e.resolveMembership(opt)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[mem]; ok {
+			return nil, &tcpip.ErrInvalidOptionValue{}
+		}
+		seen[mem] = struct{}{}
+		mems = append(mems, mem)
+	}
+	return mems, nil
+}
+
 // GetSockOpt returns the socket option.
 func (e *Endpoint) GetSockOpt(opt tcpip.GettableSocketOption) tcpip.Error {
 	switch o := opt.(type) {
@@ -999,19 +2167,148 @@ func (e *Endpoint) GetSockOpt(opt tcpip.GettableSocketOption) tcpip.Error {
 		}
 		e.mu.Unlock()
 
+	case *tcpip.PreferredSourceOption:
+		e.mu.RLock()
+		*o = tcpip.PreferredSourceOption(e.preferredSource)
+		e.mu.RUnlock()
+
 	default:
 		return &tcpip.ErrUnknownProtocolOption{}
 	}
 	return nil
 }
 
+// MulticastAll returns true iff the endpoint should receive packets destined
+// to any multicast group joined on the receiving interface, not just the groups
+// joined by the endpoint (see IP_MULTICAST_ALL).
+func (e *Endpoint) MulticastAll() bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.multicastAll
+}
+
+// MulticastAllowed returns true iff a packet destined to addr that arrived on
+// nicID may be delivered to the endpoint.
+//
+// Like Linux, a packet destined to a multicast group is only delivered if the
+// endpoint joined the group on nicID or IP_MULTICAST_ALL is enabled.
+func (e *Endpoint) MulticastAllowed(nicID tcpip.NICID, addr tcpip.Address) bool {
+	if !header.IsV4MulticastAddress(addr) && !header.IsV6MulticastAddress(addr) {
+		return true
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.multicastAll {
+		return true
+	}
+	_, ok := e.multicastMemberships[multicastMembership{nicID: nicID, multicastAddr: addr}]
+	return ok
+}
+
+// NumMulticastMemberships returns the number of multicast group memberships
+// held by the endpoint. A membership is counted once per interface it was
+// joined on.
+func (e *Endpoint) NumMulticastMemberships() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return len(e.multicastMemberships)
+}
+
+// SendConfig is a snapshot of the endpoint options that affect how outgoing
+// packets are routed and which header values they carry.
+type SendConfig struct {
+	IPv4TTL          uint8
+	IPv6HopLimit     int16
+	DefaultTTL       uint8
+	MulticastTTL     uint8
+	MulticastAddr    tcpip.Address
+	MulticastNICID   tcpip.NICID
+	MulticastAll     bool
+	IPv4UnicastNICID tcpip.NICID
+	IPv6UnicastNICID tcpip.NICID
+	IPv4TOS          uint8
+	IPv6TClass       uint8
+	ECN              int
+	Broadcast        bool
+	MulticastLoop    bool
+}
+
+// SendConfig returns a snapshot of the endpoint's send configuration.
+//
+// The endpoint's own options are read under a single critical section so
+// they are consistent with each other. Broadcast and MulticastLoop are socket
+// options that may change independently of the endpoint.
+func (e *Endpoint) SendConfig() SendConfig {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return SendConfig{
+		IPv4TTL:          e.ipv4TTL,
+		IPv6HopLimit:     e.ipv6HopLimit,
+		DefaultTTL:       e.defaultTTL,
+		MulticastTTL:     e.multicastTTL,
+		MulticastAddr:    e.multicastAddr,
+		MulticastNICID:   e.multicastNICID,
+		MulticastAll:     e.multicastAll,
+		IPv4UnicastNICID: e.ipv4UnicastNICID,
+		IPv6UnicastNICID: e.ipv6UnicastNICID,
+		IPv4TOS:          e.ipv4TOS,
+		IPv6TClass:       e.ipv6TClass,
+		ECN:              e.ecn,
+		Broadcast:        e.ops.GetBroadcast(),
+		MulticastLoop:    e.ops.GetMulticastLoop(),
+	}
+}
+
 // Info returns a copy of the endpoint info.
+//
+// The info's ID holds the addresses the endpoint is registered with, so an
+// endpoint bound to the unspecified address keeps an empty local address
+// after it is connected. See ConnectedInfo.
 func (e *Endpoint) Info() stack.TransportEndpointInfo {
 	e.infoMu.RLock()
 	defer e.infoMu.RUnlock()
 	return e.info
 }
 
+// ConnectedInfo returns a copy of the endpoint info whose ID, if the endpoint
+// is connected, holds the local and remote addresses of the connected route so
+// that it is consistent with GetLocalAddress and GetRemoteAddress.
+func (e *Endpoint) ConnectedInfo() stack.TransportEndpointInfo {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	info := e.Info()
+	if e.State() == transport.DatagramEndpointStateConnected {
+		if !e.sourceFloatsRLocked() {
+			info.ID.LocalAddress = e.connectedRoute.LocalAddress()
+		}
+		info.ID.RemoteAddress = e.connectedRoute.RemoteAddress()
+	}
+	return info
+}
+
+// broadcastAllowedRLocked returns true iff the endpoint may send to a
+// broadcast destination.
+//
+// Like Linux, this applies to header-included packets too; raw_sendmsg fails
+// with EACCES without SO_BROADCAST even if IP_HDRINCL is set.
+//
+// +checklocksread:e.mu
+func (e *Endpoint) broadcastAllowedRLocked() bool {
+	return e.ops.GetBroadcast() || e.broadcastUnrestricted
+}
+
+// sourceFloatsRLocked returns whether the source address of packets written by
+// the connected endpoint is selected for each packet rather than taken from the
+// connected route (see FloatingSourceOption).
+//
+// +checklocksread:e.mu
+func (e *Endpoint) sourceFloatsRLocked() bool {
+	return e.floatingSource && e.Info().ID.LocalAddress.BitLen() == 0
+}
+
 // setInfo sets the endpoint's info.
 //
 // e.mu must be held to synchronize changes to info with the rest of the
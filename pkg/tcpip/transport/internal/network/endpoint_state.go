@@ -30,8 +30,8 @@ func (e *Endpoint) Resume(s *stack.Stack) {
 	e.stack = s
 
 	for m := range e.multicastMemberships {
-		if err := e.stack.JoinGroup(e.netProto, m.nicID, m.multicastAddr); err != nil {
-			panic(fmt.Sprintf("e.stack.JoinGroup(%d, %d, %s): %s", e.netProto, m.nicID, m.multicastAddr, err))
+		if err := e.stack.JoinGroup(e.NetProto(), m.nicID, m.multicastAddr); err != nil {
+			panic(fmt.Sprintf("e.stack.JoinGroup(%d, %d, %s): %s", e.NetProto(), m.nicID, m.multicastAddr, err))
 		}
 	}
 
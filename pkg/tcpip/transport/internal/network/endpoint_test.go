@@ -16,12 +16,14 @@ package network_test
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
 	"gvisor.dev/gvisor/pkg/buffer"
 	"gvisor.dev/gvisor/pkg/refs"
+	"gvisor.dev/gvisor/pkg/sync"
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/checker"
 	"gvisor.dev/gvisor/pkg/tcpip/faketime"
@@ -45,6 +47,60 @@ var (
 	ipv6RemoteAddr = testutil.MustParse6("b::1")
 )
 
+// channelQueueSize is the number of outgoing packets a channel link endpoint
+// added by addChannelNIC holds before dropping packets.
+const channelQueueSize = 4
+
+// addChannelNIC adds a NIC backed by a channel link endpoint to s and assigns
+// the provided addresses to it.
+func addChannelNIC(t testing.TB, s *stack.Stack, nicID tcpip.NICID, addrs ...tcpip.Address) *channel.Endpoint {
+	t.Helper()
+
+	e := channel.New(channelQueueSize, header.IPv6MinimumMTU, "")
+	t.Cleanup(e.Close)
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("s.CreateNIC(%d, _): %s", nicID, err)
+	}
+	for _, addr := range addrs {
+		protocolAddr := tcpip.ProtocolAddress{
+			Protocol:          ipv4.ProtocolNumber,
+			AddressWithPrefix: addr.WithPrefix(),
+		}
+		if addr.Len() == header.IPv6AddressSize {
+			protocolAddr.Protocol = ipv6.ProtocolNumber
+		}
+		if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+			t.Fatalf("s.AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+		}
+	}
+	return e
+}
+
+// newStack returns a stack with the provided network protocols and the UDP
+// transport protocol. The stack is destroyed when the test finishes.
+func newStack(t testing.TB, netProtos ...stack.NetworkProtocolFactory) *stack.Stack {
+	s := stack.New(stack.Options{
+		NetworkProtocols:   netProtos,
+		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+		Clock:              &faketime.NullClock{},
+	})
+	t.Cleanup(s.Destroy)
+	return s
+}
+
+// newEndpoint returns an initialized UDP endpoint for netProto on s along with
+// its socket options, whose handler calls back into the endpoint. The endpoint
+// is closed when the test finishes.
+func newEndpoint(t testing.TB, s *stack.Stack, netProto tcpip.NetworkProtocolNumber) (*network.Endpoint, *tcpip.SocketOptions) {
+	var ops tcpip.SocketOptions
+	var ep network.Endpoint
+	var wq waiter.Queue
+	ops.InitHandler(&endpointOptionsHandler{s: s, ep: &ep}, s, tcpip.GetStackSendBufferLimits, tcpip.GetStackReceiveBufferLimits)
+	ep.Init(s, netProto, udp.ProtocolNumber, &ops, &wq)
+	t.Cleanup(ep.Close)
+	return &ep, &ops
+}
+
 func TestEndpointStateTransitions(t *testing.T) {
 	const nicID = 1
 
@@ -200,6 +256,7 @@ func TestEndpointStateTransitions(t *testing.T) {
 				RemoteAddress:               test.expectedRemoteAddr,
 				MaxHeaderLength:             test.expectedMaxHeaderLength,
 				RequiresTXTransportChecksum: true,
+				TTL:                         ipv4.DefaultTTL,
 			}, info); diff != "" {
 				t.Errorf("write packet info mismatch (-want +got):\n%s", diff)
 			}
@@ -329,6 +386,3700 @@ func TestBindNICID(t *testing.T) {
 	}
 }
 
+func TestMulticastAllOption(t *testing.T) {
+	for _, netProto := range []tcpip.NetworkProtocolNumber{ipv4.ProtocolNumber, ipv6.ProtocolNumber} {
+		t.Run(fmt.Sprintf("NetProto=%d", netProto), func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+
+			ep, _ := newEndpoint(t, s, netProto)
+
+			// Linux defaults IP_MULTICAST_ALL to enabled.
+			if v, err := ep.GetSockOptInt(tcpip.MulticastAllOption); err != nil {
+				t.Fatalf("ep.GetSockOptInt(tcpip.MulticastAllOption): %s", err)
+			} else if v != 1 {
+				t.Errorf("got ep.GetSockOptInt(tcpip.MulticastAllOption) = %d, want = 1", v)
+			}
+			if !ep.MulticastAll() {
+				t.Error("got ep.MulticastAll() = false, want = true")
+			}
+
+			for _, test := range []struct {
+				v       int
+				wantErr tcpip.Error
+				want    int
+			}{
+				{v: 0, want: 0},
+				{v: 1, want: 1},
+				{v: 0, want: 0},
+				{v: 2, wantErr: &tcpip.ErrInvalidOptionValue{}, want: 0},
+				{v: -1, wantErr: &tcpip.ErrInvalidOptionValue{}, want: 0},
+			} {
+				if diff := cmp.Diff(test.wantErr, ep.SetSockOptInt(tcpip.MulticastAllOption, test.v)); diff != "" {
+					t.Errorf("ep.SetSockOptInt(tcpip.MulticastAllOption, %d) mismatch (-want +got):\n%s", test.v, diff)
+				}
+				if v, err := ep.GetSockOptInt(tcpip.MulticastAllOption); err != nil {
+					t.Fatalf("ep.GetSockOptInt(tcpip.MulticastAllOption): %s", err)
+				} else if v != test.want {
+					t.Errorf("got ep.GetSockOptInt(tcpip.MulticastAllOption) = %d, want = %d", v, test.want)
+				}
+				if got, want := ep.MulticastAll(), test.want != 0; got != want {
+					t.Errorf("got ep.MulticastAll() = %t, want = %t", got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendConfig(t *testing.T) {
+	const nicID = 1
+
+	s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+	if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+		t.Fatalf("s.CreateNIC(%d, _): %s", nicID, err)
+	}
+
+	ep, ops := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+	want := network.SendConfig{
+		IPv4TTL:      tcpip.UseDefaultIPv4TTL,
+		IPv6HopLimit: tcpip.UseDefaultIPv6HopLimit,
+		MulticastTTL: 1,
+		MulticastAll: true,
+	}
+	if diff := cmp.Diff(want, ep.SendConfig()); diff != "" {
+		t.Errorf("ep.SendConfig() mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, opt := range []struct {
+		opt tcpip.SockOptInt
+		v   int
+	}{
+		{opt: tcpip.IPv4TTLOption, v: 10},
+		{opt: tcpip.IPv6HopLimitOption, v: 20},
+		{opt: tcpip.MulticastTTLOption, v: 30},
+		{opt: tcpip.MulticastAllOption, v: 0},
+		{opt: tcpip.IPv4TOSOption, v: 40},
+		{opt: tcpip.IPv6TrafficClassOption, v: 50},
+	} {
+		if err := ep.SetSockOptInt(opt.opt, opt.v); err != nil {
+			t.Fatalf("ep.SetSockOptInt(%d, %d): %s", opt.opt, opt.v, err)
+		}
+	}
+	ifOpt := tcpip.MulticastInterfaceOption{NIC: nicID}
+	if err := ep.SetSockOpt(&ifOpt); err != nil {
+		t.Fatalf("ep.SetSockOpt(&%#v): %s", ifOpt, err)
+	}
+	ops.SetBroadcast(true)
+	ops.SetMulticastLoop(true)
+
+	want = network.SendConfig{
+		IPv4TTL:        10,
+		IPv6HopLimit:   20,
+		MulticastTTL:   30,
+		MulticastNICID: nicID,
+		MulticastAll:   false,
+		IPv4TOS:        40,
+		IPv6TClass:     50,
+		Broadcast:      true,
+		MulticastLoop:  true,
+	}
+	if diff := cmp.Diff(want, ep.SendConfig()); diff != "" {
+		t.Errorf("ep.SendConfig() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestScopedIPv6MulticastWrite(t *testing.T) {
+	const (
+		nicID1       = 1
+		nicID2       = 2
+		unknownNICID = 3
+	)
+
+	var (
+		nic1Addr                = testutil.MustParse6("fe80::1")
+		nic2Addr                = testutil.MustParse6("fe80::2")
+		interfaceLocalMulticast = testutil.MustParse6("ff01::1")
+	)
+
+	tests := []struct {
+		name        string
+		to          tcpip.FullAddress
+		wantErr     tcpip.Error
+		wantNICID   tcpip.NICID
+		wantSrcAddr tcpip.Address
+	}{
+		{
+			name:        "link-local without zone uses multicast interface",
+			to:          tcpip.FullAddress{Addr: header.IPv6AllNodesMulticastAddress},
+			wantNICID:   nicID1,
+			wantSrcAddr: nic1Addr,
+		},
+		{
+			name:        "link-local with zone",
+			to:          tcpip.FullAddress{NIC: nicID2, Addr: header.IPv6AllNodesMulticastAddress},
+			wantNICID:   nicID2,
+			wantSrcAddr: nic2Addr,
+		},
+		{
+			name:        "interface-local with zone",
+			to:          tcpip.FullAddress{NIC: nicID2, Addr: interfaceLocalMulticast},
+			wantNICID:   nicID2,
+			wantSrcAddr: nic2Addr,
+		},
+		{
+			name:    "link-local with unknown zone",
+			to:      tcpip.FullAddress{NIC: unknownNICID, Addr: header.IPv6AllNodesMulticastAddress},
+			wantErr: &tcpip.ErrNetworkUnreachable{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv6.NewProtocol)
+
+			links := make(map[tcpip.NICID]*channel.Endpoint)
+			for nicID, addr := range map[tcpip.NICID]tcpip.Address{nicID1: nic1Addr, nicID2: nic2Addr} {
+				e := channel.New(1, header.IPv6MinimumMTU, "")
+				defer e.Close()
+				if err := s.CreateNIC(nicID, e); err != nil {
+					t.Fatalf("s.CreateNIC(%d, _): %s", nicID, err)
+				}
+				protocolAddr := tcpip.ProtocolAddress{
+					Protocol:          ipv6.ProtocolNumber,
+					AddressWithPrefix: addr.WithPrefix(),
+				}
+				if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+					t.Fatalf("s.AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+				}
+				links[nicID] = e
+			}
+
+			ep, _ := newEndpoint(t, s, ipv6.ProtocolNumber)
+
+			ifOpt := tcpip.MulticastInterfaceOption{NIC: nicID1}
+			if err := ep.SetSockOpt(&ifOpt); err != nil {
+				t.Fatalf("ep.SetSockOpt(&%#v): %s", ifOpt, err)
+			}
+
+			writeOpts := tcpip.WriteOptions{To: &test.to}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Fatalf("unexpected error from ep.AcquireContextForWrite(%#v), (-want, +got):\n%s", writeOpts, diff)
+			}
+			if err != nil {
+				return
+			}
+			defer ctx.Release()
+
+			info := ctx.PacketInfo()
+			if info.LocalAddress != test.wantSrcAddr {
+				t.Errorf("got info.LocalAddress = %s, want = %s", info.LocalAddress, test.wantSrcAddr)
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				ReserveHeaderBytes: int(info.MaxHeaderLength),
+			})
+			defer pkt.DecRef()
+			if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+				t.Fatalf("ctx.WritePacket(_, false): %s", err)
+			}
+			for nicID, e := range links {
+				pkt := e.Read()
+				if got, want := !pkt.IsNil(), nicID == test.wantNICID; got != want {
+					t.Errorf("got packet read from NIC %d = %t, want = %t", nicID, got, want)
+				}
+				if !pkt.IsNil() {
+					pkt.DecRef()
+				}
+			}
+		})
+	}
+}
+
+func TestResetAndReuse(t *testing.T) {
+	const nicID = 1
+
+	s := newStack(t, ipv4.NewProtocol)
+	if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+		t.Fatalf("s.CreateNIC(%d, _): %s", nicID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: ipv4NICAddr.WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("s.AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID}})
+
+	var ops tcpip.SocketOptions
+	var ep network.Endpoint
+	var wq waiter.Queue
+	for i := 0; i < 2; i++ {
+		ep.Init(s, ipv4.ProtocolNumber, udp.ProtocolNumber, &ops, &wq)
+		if ep.WasBound() {
+			t.Fatalf("%d: got ep.WasBound() = true, want = false", i)
+		}
+		wantConfig := network.SendConfig{
+			IPv6HopLimit: tcpip.UseDefaultIPv6HopLimit,
+			MulticastTTL: 1,
+			MulticastAll: true,
+		}
+		if diff := cmp.Diff(wantConfig, ep.SendConfig()); diff != "" {
+			t.Fatalf("%d: ep.SendConfig() mismatch (-want +got):\n%s", i, diff)
+		}
+
+		bindAddr := tcpip.FullAddress{Addr: ipv4NICAddr}
+		if err := ep.Bind(bindAddr); err != nil {
+			t.Fatalf("%d: ep.Bind(%#v): %s", i, bindAddr, err)
+		}
+		memOpt := tcpip.AddMembershipOption{NIC: nicID, MulticastAddr: header.IPv4AllRoutersGroup}
+		if err := ep.SetSockOpt(&memOpt); err != nil {
+			t.Fatalf("%d: ep.SetSockOpt(&%#v): %s", i, memOpt, err)
+		}
+		if err := ep.SetSockOptInt(tcpip.IPv4TOSOption, 1); err != nil {
+			t.Fatalf("%d: ep.SetSockOptInt(tcpip.IPv4TOSOption, 1): %s", i, err)
+		}
+		connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+		if err := ep.Connect(connectAddr); err != nil {
+			t.Fatalf("%d: ep.Connect(%#v): %s", i, connectAddr, err)
+		}
+
+		ep.Close()
+		if joined, err := s.IsInGroup(nicID, header.IPv4AllRoutersGroup); err != nil {
+			t.Fatalf("%d: s.IsInGroup(%d, %s): %s", i, nicID, header.IPv4AllRoutersGroup, err)
+		} else if joined {
+			t.Errorf("%d: got s.IsInGroup(%d, %s) = true, want = false", i, nicID, header.IPv4AllRoutersGroup)
+		}
+		ep.Reset()
+		if diff := cmp.Diff(stack.TransportEndpointInfo{}, ep.Info()); diff != "" {
+			t.Errorf("%d: ep.Info() mismatch (-want +got):\n%s", i, diff)
+		}
+		if diff := cmp.Diff(network.SendConfig{}, ep.SendConfig()); diff != "" {
+			t.Errorf("%d: ep.SendConfig() mismatch (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+type testOwner struct {
+	uid, gid uint32
+}
+
+func (o *testOwner) KUID() uint32 { return o.uid }
+func (o *testOwner) KGID() uint32 { return o.gid }
+
+func TestOwner(t *testing.T) {
+	const nicID = 1
+
+	s := newStack(t, ipv4.NewProtocol)
+	e := channel.New(1, header.IPv6MinimumMTU, "")
+	defer e.Close()
+	if err := s.CreateNIC(nicID, e); err != nil {
+		t.Fatalf("s.CreateNIC(%d, _): %s", nicID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: ipv4NICAddr.WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("s.AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID}})
+
+	ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+	connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+	if err := ep.Connect(connectAddr); err != nil {
+		t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+	}
+
+	if owner := ep.GetOwner(); owner != nil {
+		t.Errorf("got ep.GetOwner() = %#v, want = nil", owner)
+	}
+
+	writeWithOwner := func(ctx network.WriteContext) tcpip.PacketOwner {
+		t.Helper()
+
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+		})
+		defer pkt.DecRef()
+		if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+			t.Fatalf("ctx.WritePacket(_, false): %s", err)
+		}
+		written := e.Read()
+		if written.IsNil() {
+			t.Fatal("expected packet to be read from link endpoint")
+		}
+		defer written.DecRef()
+		return written.Owner
+	}
+
+	owner1 := &testOwner{uid: 1, gid: 1}
+	owner2 := &testOwner{uid: 2, gid: 2}
+
+	// The owner is captured when the write context is acquired.
+	ep.SetOwner(owner1)
+	ctx, err := ep.AcquireContextForWrite(tcpip.WriteOptions{})
+	if err != nil {
+		t.Fatalf("ep.AcquireContextForWrite({}): %s", err)
+	}
+	ep.SetOwner(owner2)
+	if got := ep.GetOwner(); got != owner2 {
+		t.Errorf("got ep.GetOwner() = %#v, want = %#v", got, owner2)
+	}
+	if got := writeWithOwner(ctx); got != owner1 {
+		t.Errorf("got packet owner = %#v, want = %#v", got, owner1)
+	}
+	ctx.Release()
+
+	ctx, err = ep.AcquireContextForWrite(tcpip.WriteOptions{})
+	if err != nil {
+		t.Fatalf("ep.AcquireContextForWrite({}): %s", err)
+	}
+	if got := writeWithOwner(ctx); got != owner2 {
+		t.Errorf("got packet owner = %#v, want = %#v", got, owner2)
+	}
+	ctx.Release()
+}
+
+func TestOwnerRace(t *testing.T) {
+	const (
+		nicID      = 1
+		iterations = 1000
+	)
+
+	s := newStack(t, ipv4.NewProtocol)
+	if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+		t.Fatalf("s.CreateNIC(%d, _): %s", nicID, err)
+	}
+	protocolAddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: ipv4NICAddr.WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+		t.Fatalf("s.AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID}})
+
+	ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+	connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+	if err := ep.Connect(connectAddr); err != nil {
+		t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+	}
+
+	owners := []tcpip.PacketOwner{&testOwner{uid: 1, gid: 1}, &testOwner{uid: 2, gid: 2}}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			ep.SetOwner(owners[i%len(owners)])
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < iterations; i++ {
+			ctx, err := ep.AcquireContextForWrite(tcpip.WriteOptions{})
+			if err != nil {
+				t.Errorf("ep.AcquireContextForWrite({}): %s", err)
+				return
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+			})
+			if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+				t.Errorf("ctx.WritePacket(_, false): %s", err)
+			}
+			pkt.DecRef()
+			ctx.Release()
+		}
+	}()
+	wg.Wait()
+}
+
+func TestUnicastInterface(t *testing.T) {
+	const (
+		nicID1       = 1
+		nicID2       = 2
+		unknownNICID = 3
+	)
+
+	nic2Addr := testutil.MustParse4("2.3.4.5")
+
+	s := newStack(t, ipv4.NewProtocol)
+	links := map[tcpip.NICID]*channel.Endpoint{
+		nicID1: addChannelNIC(t, s, nicID1, ipv4NICAddr),
+		nicID2: addChannelNIC(t, s, nicID2, nic2Addr),
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID1},
+		{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID2},
+	})
+
+	ep, ops := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+	if v, err := ep.GetSockOptInt(tcpip.UnicastInterfaceOption); err != nil {
+		t.Fatalf("ep.GetSockOptInt(tcpip.UnicastInterfaceOption): %s", err)
+	} else if v != 0 {
+		t.Errorf("got ep.GetSockOptInt(tcpip.UnicastInterfaceOption) = %d, want = 0", v)
+	}
+	if err := ep.SetSockOptInt(tcpip.UnicastInterfaceOption, unknownNICID); err == nil {
+		t.Errorf("got ep.SetSockOptInt(tcpip.UnicastInterfaceOption, %d) = nil, want non-nil", unknownNICID)
+	}
+	if err := ep.SetSockOptInt(tcpip.UnicastInterfaceOption, nicID2); err != nil {
+		t.Fatalf("ep.SetSockOptInt(tcpip.UnicastInterfaceOption, %d): %s", nicID2, err)
+	}
+	if v, err := ep.GetSockOptInt(tcpip.UnicastInterfaceOption); err != nil {
+		t.Fatalf("ep.GetSockOptInt(tcpip.UnicastInterfaceOption): %s", err)
+	} else if v != nicID2 {
+		t.Errorf("got ep.GetSockOptInt(tcpip.UnicastInterfaceOption) = %d, want = %d", v, nicID2)
+	}
+	ifOpt := tcpip.MulticastInterfaceOption{NIC: nicID1}
+	if err := ep.SetSockOpt(&ifOpt); err != nil {
+		t.Fatalf("ep.SetSockOpt(&%#v): %s", ifOpt, err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		dst       tcpip.Address
+		wantNICID tcpip.NICID
+		wantSrc   tcpip.Address
+	}{
+		{
+			name:      "unicast",
+			dst:       ipv4RemoteAddr,
+			wantNICID: nicID2,
+			wantSrc:   nic2Addr,
+		},
+		{
+			name:      "multicast",
+			dst:       header.IPv4AllSystems,
+			wantNICID: nicID1,
+			wantSrc:   ipv4NICAddr,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: test.dst}}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if err != nil {
+				t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+			}
+			defer ctx.Release()
+
+			info := ctx.PacketInfo()
+			if info.LocalAddress != test.wantSrc {
+				t.Errorf("got info.LocalAddress = %s, want = %s", info.LocalAddress, test.wantSrc)
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				ReserveHeaderBytes: int(info.MaxHeaderLength),
+			})
+			defer pkt.DecRef()
+			if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+				t.Fatalf("ctx.WritePacket(_, false): %s", err)
+			}
+			for nicID, e := range links {
+				pkt := e.Read()
+				if got, want := !pkt.IsNil(), nicID == test.wantNICID; got != want {
+					t.Errorf("got packet read from NIC %d = %t, want = %t", nicID, got, want)
+				}
+				if !pkt.IsNil() {
+					pkt.DecRef()
+				}
+			}
+		})
+	}
+
+	// The IPv6 unicast interface is kept separately.
+	if v, err := ep.GetSockOptInt(tcpip.IPv6UnicastInterfaceOption); err != nil {
+		t.Fatalf("ep.GetSockOptInt(tcpip.IPv6UnicastInterfaceOption): %s", err)
+	} else if v != 0 {
+		t.Errorf("got ep.GetSockOptInt(tcpip.IPv6UnicastInterfaceOption) = %d, want = 0", v)
+	}
+
+	// Like Linux, only IPv6 accepts the bound device as the unicast interface.
+	if err := ops.SetBindToDevice(nicID1); err != nil {
+		t.Fatalf("ops.SetBindToDevice(%d): %s", nicID1, err)
+	}
+	for _, test := range []struct {
+		opt     tcpip.SockOptInt
+		v       int
+		wantErr tcpip.Error
+	}{
+		{opt: tcpip.UnicastInterfaceOption, v: nicID1, wantErr: &tcpip.ErrInvalidOptionValue{}},
+		{opt: tcpip.UnicastInterfaceOption, v: nicID2, wantErr: &tcpip.ErrInvalidOptionValue{}},
+		{opt: tcpip.UnicastInterfaceOption, v: 0},
+		{opt: tcpip.IPv6UnicastInterfaceOption, v: nicID1},
+		{opt: tcpip.IPv6UnicastInterfaceOption, v: nicID2, wantErr: &tcpip.ErrInvalidOptionValue{}},
+	} {
+		if diff := cmp.Diff(test.wantErr, ep.SetSockOptInt(test.opt, test.v)); diff != "" {
+			t.Errorf("ep.SetSockOptInt(%d, %d) mismatch (-want +got):\n%s", test.opt, test.v, diff)
+		}
+	}
+}
+
+func TestConnectAndThenCallbackError(t *testing.T) {
+	const nicID = 1
+
+	otherRemoteAddr := testutil.MustParse4("6.7.8.10")
+
+	tests := []struct {
+		name      string
+		bind      bool
+		connect   bool
+		wantState transport.DatagramEndpointState
+	}{
+		{
+			name:      "initial",
+			wantState: transport.DatagramEndpointStateInitial,
+		},
+		{
+			name:      "bound",
+			bind:      true,
+			wantState: transport.DatagramEndpointStateBound,
+		},
+		{
+			name:      "connected",
+			connect:   true,
+			wantState: transport.DatagramEndpointStateConnected,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr)
+			s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+			ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+			if test.bind {
+				bindAddr := tcpip.FullAddress{Addr: ipv4NICAddr}
+				if err := ep.Bind(bindAddr); err != nil {
+					t.Fatalf("ep.Bind(%#v): %s", bindAddr, err)
+				}
+			}
+			if test.connect {
+				connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+				if err := ep.Connect(connectAddr); err != nil {
+					t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+				}
+			}
+			wantInfo := ep.Info()
+			wantRemoteAddr, wantConnected := ep.GetRemoteAddress()
+
+			// The route acquired for the failed connect must be released, which
+			// is verified by the leak checker when the stack is destroyed.
+			connectAddr := tcpip.FullAddress{Addr: otherRemoteAddr}
+			wantErr := &tcpip.ErrConnectionRefused{}
+			called := false
+			err := ep.ConnectAndThen(connectAddr, func(tcpip.NetworkProtocolNumber, stack.TransportEndpointID, stack.TransportEndpointID) tcpip.Error {
+				called = true
+				return wantErr
+			})
+			if !called {
+				t.Errorf("ep.ConnectAndThen(%#v, _) did not call the callback", connectAddr)
+			}
+			if diff := cmp.Diff(tcpip.Error(wantErr), err); diff != "" {
+				t.Errorf("unexpected error from ep.ConnectAndThen(%#v, _), (-want, +got):\n%s", connectAddr, diff)
+			}
+
+			if state := ep.State(); state != test.wantState {
+				t.Errorf("got ep.State() = %s, want = %s", state, test.wantState)
+			}
+			if diff := cmp.Diff(wantInfo, ep.Info()); diff != "" {
+				t.Errorf("ep.Info() mismatch (-want +got):\n%s", diff)
+			}
+			remoteAddr, connected := ep.GetRemoteAddress()
+			if connected != wantConnected {
+				t.Errorf("got ep.GetRemoteAddress() connected = %t, want = %t", connected, wantConnected)
+			}
+			if diff := cmp.Diff(wantRemoteAddr, remoteAddr); diff != "" {
+				t.Errorf("ep.GetRemoteAddress() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestConnectAndThenSelectedLocalAddress(t *testing.T) {
+	const nicID = 1
+
+	s := newStack(t, ipv4.NewProtocol)
+	addChannelNIC(t, s, nicID, ipv4NICAddr)
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+	ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+	connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+	for _, reject := range []bool{true, false} {
+		var gotLocalAddr tcpip.Address
+		err := ep.ConnectAndThen(connectAddr, func(_ tcpip.NetworkProtocolNumber, previousID, nextID stack.TransportEndpointID) tcpip.Error {
+			if previousID.LocalAddress.BitLen() != 0 {
+				t.Errorf("got previousID.LocalAddress = %s, want empty", previousID.LocalAddress)
+			}
+			gotLocalAddr = nextID.LocalAddress
+			if reject {
+				return &tcpip.ErrBadLocalAddress{}
+			}
+			return nil
+		})
+		if gotLocalAddr != ipv4NICAddr {
+			t.Errorf("got nextID.LocalAddress = %s, want = %s", gotLocalAddr, ipv4NICAddr)
+		}
+
+		if reject {
+			if diff := cmp.Diff(&tcpip.ErrBadLocalAddress{}, err); diff != "" {
+				t.Errorf("unexpected error from ep.ConnectAndThen(%#v, _), (-want, +got):\n%s", connectAddr, diff)
+			}
+			if state := ep.State(); state != transport.DatagramEndpointStateInitial {
+				t.Errorf("got ep.State() = %s, want = %s", state, transport.DatagramEndpointStateInitial)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("ep.ConnectAndThen(%#v, _): %s", connectAddr, err)
+		}
+		if diff := cmp.Diff(tcpip.FullAddress{Addr: ipv4NICAddr}, ep.GetLocalAddress()); diff != "" {
+			t.Errorf("ep.GetLocalAddress() mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestIPv6AddrForm(t *testing.T) {
+	const nicID = 1
+
+	tests := []struct {
+		name         string
+		netProto     tcpip.NetworkProtocolNumber
+		connectAddr  tcpip.Address
+		value        tcpip.NetworkProtocolNumber
+		wantErr      tcpip.Error
+		wantNetProto tcpip.NetworkProtocolNumber
+	}{
+		{
+			name:         "IPv4-mapped peer",
+			netProto:     ipv6.ProtocolNumber,
+			connectAddr:  testutil.MustParse6("::ffff:0607:0809"),
+			value:        ipv4.ProtocolNumber,
+			wantNetProto: ipv4.ProtocolNumber,
+		},
+		{
+			name:         "not connected",
+			netProto:     ipv6.ProtocolNumber,
+			value:        ipv4.ProtocolNumber,
+			wantErr:      &tcpip.ErrNotConnected{},
+			wantNetProto: ipv6.ProtocolNumber,
+		},
+		{
+			name:         "IPv6 peer",
+			netProto:     ipv6.ProtocolNumber,
+			connectAddr:  ipv6RemoteAddr,
+			value:        ipv4.ProtocolNumber,
+			wantErr:      &tcpip.ErrBadLocalAddress{},
+			wantNetProto: ipv6.ProtocolNumber,
+		},
+		{
+			name:         "invalid value",
+			netProto:     ipv6.ProtocolNumber,
+			connectAddr:  testutil.MustParse6("::ffff:0607:0809"),
+			value:        ipv6.ProtocolNumber,
+			wantErr:      &tcpip.ErrInvalidOptionValue{},
+			wantNetProto: ipv6.ProtocolNumber,
+		},
+		{
+			name:         "IPv4 endpoint",
+			netProto:     ipv4.ProtocolNumber,
+			connectAddr:  ipv4RemoteAddr,
+			value:        ipv4.ProtocolNumber,
+			wantErr:      &tcpip.ErrUnknownProtocolOption{},
+			wantNetProto: ipv4.ProtocolNumber,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr, ipv6NICAddr)
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+				{Destination: ipv6RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+			})
+
+			ep, _ := newEndpoint(t, s, test.netProto)
+
+			if test.connectAddr.BitLen() != 0 {
+				connectAddr := tcpip.FullAddress{Addr: test.connectAddr}
+				if err := ep.Connect(connectAddr); err != nil {
+					t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+				}
+			}
+
+			err := ep.SetSockOptInt(tcpip.IPv6AddrFormOption, int(test.value))
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Errorf("unexpected error from ep.SetSockOptInt(tcpip.IPv6AddrFormOption, %d), (-want, +got):\n%s", test.value, diff)
+			}
+
+			if got := ep.NetProto(); got != test.wantNetProto {
+				t.Errorf("got ep.NetProto() = %d, want = %d", got, test.wantNetProto)
+			}
+			if got := ep.Info().NetProto; got != test.wantNetProto {
+				t.Errorf("got ep.Info().NetProto = %d, want = %d", got, test.wantNetProto)
+			}
+			if v, err := ep.GetSockOptInt(tcpip.IPv6AddrFormOption); err != nil {
+				t.Fatalf("ep.GetSockOptInt(tcpip.IPv6AddrFormOption): %s", err)
+			} else if got := tcpip.NetworkProtocolNumber(v); got != test.wantNetProto {
+				t.Errorf("got ep.GetSockOptInt(tcpip.IPv6AddrFormOption) = %d, want = %d", got, test.wantNetProto)
+			}
+			if err != nil {
+				return
+			}
+
+			// The converted endpoint accepts IPv4 multicast memberships and keeps
+			// sending to its IPv4 peer.
+			memOpt := tcpip.AddMembershipOption{NIC: nicID, MulticastAddr: header.IPv4AllRoutersGroup}
+			if err := ep.SetSockOpt(&memOpt); err != nil {
+				t.Errorf("ep.SetSockOpt(&%#v): %s", memOpt, err)
+			}
+			ctx, err := ep.AcquireContextForWrite(tcpip.WriteOptions{})
+			if err != nil {
+				t.Fatalf("ep.AcquireContextForWrite({}): %s", err)
+			}
+			defer ctx.Release()
+			if diff := cmp.Diff(network.WritePacketInfo{
+				NetProto:                    ipv4.ProtocolNumber,
+				LocalAddress:                ipv4NICAddr,
+				RemoteAddress:               ipv4RemoteAddr,
+				MaxHeaderLength:             header.IPv4MaximumHeaderSize,
+				RequiresTXTransportChecksum: true,
+				TTL:                         ipv4.DefaultTTL,
+			}, ctx.PacketInfo()); diff != "" {
+				t.Errorf("write packet info mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteDestinationFamily(t *testing.T) {
+	const nicID = 1
+
+	for _, test := range []struct {
+		name     string
+		netProto tcpip.NetworkProtocolNumber
+		v6Only   bool
+		dst      tcpip.Address
+		wantErr  tcpip.Error
+	}{
+		{
+			name:     "IPv6 destination on IPv4 endpoint",
+			netProto: ipv4.ProtocolNumber,
+			dst:      ipv6RemoteAddr,
+			wantErr:  &tcpip.ErrAddressFamilyNotSupported{},
+		},
+		{
+			name:     "IPv4 destination on IPv6-only endpoint",
+			netProto: ipv6.ProtocolNumber,
+			v6Only:   true,
+			dst:      ipv4RemoteAddr,
+			wantErr:  &tcpip.ErrNetworkUnreachable{},
+		},
+		{
+			name:     "IPv4-mapped destination on IPv6-only endpoint",
+			netProto: ipv6.ProtocolNumber,
+			v6Only:   true,
+			dst:      testutil.MustParse6("::ffff:0607:0809"),
+			wantErr:  &tcpip.ErrNetworkUnreachable{},
+		},
+		{
+			name:     "IPv4 destination on dual-stack endpoint",
+			netProto: ipv6.ProtocolNumber,
+			dst:      ipv4RemoteAddr,
+		},
+		{
+			name:     "IPv6 destination on IPv6-only endpoint",
+			netProto: ipv6.ProtocolNumber,
+			v6Only:   true,
+			dst:      ipv6RemoteAddr,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr, ipv6NICAddr)
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+				{Destination: ipv6RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+			})
+
+			ep, ops := newEndpoint(t, s, test.netProto)
+			if err := ops.SetV6Only(test.v6Only); err != nil {
+				t.Fatalf("ops.SetV6Only(%t): %s", test.v6Only, err)
+			}
+
+			writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: test.dst}}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Fatalf("unexpected error from ep.AcquireContextForWrite(%#v), (-want, +got):\n%s", writeOpts, diff)
+			}
+			if err == nil {
+				ctx.Release()
+			}
+		})
+	}
+}
+
+func TestLimitedBroadcast(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	nic2Addr := testutil.MustParse4("2.3.4.5")
+
+	for _, test := range []struct {
+		name      string
+		numNICs   int
+		bindAddr  tcpip.Address
+		broadcast bool
+		connect   bool
+		wantNICID tcpip.NICID
+		wantErr   tcpip.Error
+	}{
+		{
+			name:      "single NIC",
+			numNICs:   1,
+			bindAddr:  ipv4NICAddr,
+			broadcast: true,
+			wantNICID: nicID1,
+		},
+		{
+			name:      "single NIC connected",
+			numNICs:   1,
+			bindAddr:  ipv4NICAddr,
+			broadcast: true,
+			connect:   true,
+			wantNICID: nicID1,
+		},
+		{
+			name:      "multiple NICs",
+			numNICs:   2,
+			bindAddr:  nic2Addr,
+			broadcast: true,
+			wantNICID: nicID2,
+		},
+		{
+			name:      "multiple NICs connected",
+			numNICs:   2,
+			bindAddr:  nic2Addr,
+			broadcast: true,
+			connect:   true,
+			wantNICID: nicID2,
+		},
+		{
+			name:     "broadcast disabled",
+			numNICs:  2,
+			bindAddr: nic2Addr,
+			wantErr:  &tcpip.ErrBroadcastDisabled{},
+		},
+		{
+			name:    "unbound broadcast disabled",
+			numNICs: 2,
+			wantErr: &tcpip.ErrBroadcastDisabled{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			links := map[tcpip.NICID]*channel.Endpoint{
+				nicID1: addChannelNIC(t, s, nicID1, ipv4NICAddr),
+			}
+			if test.numNICs > 1 {
+				links[nicID2] = addChannelNIC(t, s, nicID2, nic2Addr)
+			}
+
+			ep, ops := newEndpoint(t, s, ipv4.ProtocolNumber)
+			ops.SetBroadcast(test.broadcast)
+
+			if test.bindAddr.BitLen() != 0 {
+				if err := ep.Bind(tcpip.FullAddress{Addr: test.bindAddr}); err != nil {
+					t.Fatalf("ep.Bind(_): %s", err)
+				}
+			}
+
+			var writeOpts tcpip.WriteOptions
+			dst := tcpip.FullAddress{Addr: header.IPv4Broadcast}
+			if test.connect {
+				if err := ep.Connect(dst); err != nil {
+					t.Fatalf("ep.Connect(%#v): %s", dst, err)
+				}
+			} else {
+				writeOpts.To = &dst
+			}
+
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Fatalf("unexpected error from ep.AcquireContextForWrite(%#v), (-want, +got):\n%s", writeOpts, diff)
+			}
+			if err != nil {
+				return
+			}
+			defer ctx.Release()
+
+			if got := ctx.PacketInfo().LocalAddress; got != test.bindAddr {
+				t.Errorf("got ctx.PacketInfo().LocalAddress = %s, want = %s", got, test.bindAddr)
+			}
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+			})
+			defer pkt.DecRef()
+			if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+				t.Fatalf("ctx.WritePacket(_, false): %s", err)
+			}
+			for nicID, e := range links {
+				pkt := e.Read()
+				if got, want := !pkt.IsNil(), nicID == test.wantNICID; got != want {
+					t.Errorf("got packet read from NIC %d = %t, want = %t", nicID, got, want)
+				}
+				if !pkt.IsNil() {
+					pkt.DecRef()
+				}
+			}
+		})
+	}
+}
+
+func TestHeaderIncludedBroadcast(t *testing.T) {
+	const nicID = 1
+
+	for _, test := range []struct {
+		name           string
+		headerIncluded bool
+		broadcast      bool
+		wantErr        tcpip.Error
+	}{
+		{
+			name:    "header not included",
+			wantErr: &tcpip.ErrBroadcastDisabled{},
+		},
+		{
+			name:           "header included",
+			headerIncluded: true,
+			wantErr:        &tcpip.ErrBroadcastDisabled{},
+		},
+		{
+			name:           "header included with broadcast",
+			headerIncluded: true,
+			broadcast:      true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			e := addChannelNIC(t, s, nicID, ipv4NICAddr)
+
+			ep, ops := newEndpoint(t, s, ipv4.ProtocolNumber)
+			ops.SetHeaderIncluded(test.headerIncluded)
+			ops.SetBroadcast(test.broadcast)
+			bindAddr := tcpip.FullAddress{Addr: ipv4NICAddr}
+			if err := ep.Bind(bindAddr); err != nil {
+				t.Fatalf("ep.Bind(%#v): %s", bindAddr, err)
+			}
+
+			writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: header.IPv4Broadcast}}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Fatalf("unexpected error from ep.AcquireContextForWrite(%#v), (-want, +got):\n%s", writeOpts, diff)
+			}
+			if err != nil {
+				return
+			}
+			defer ctx.Release()
+
+			buf := make([]byte, header.IPv4MinimumSize)
+			header.IPv4(buf).Encode(&header.IPv4Fields{
+				TotalLength: header.IPv4MinimumSize,
+				TTL:         ipv4.DefaultTTL,
+				Protocol:    uint8(udp.ProtocolNumber),
+				SrcAddr:     ipv4NICAddr,
+				DstAddr:     header.IPv4Broadcast,
+			})
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				Payload: buffer.MakeWithData(buf),
+			})
+			defer pkt.DecRef()
+			if err := ctx.WritePacket(pkt, true /* headerIncluded */); err != nil {
+				t.Fatalf("ctx.WritePacket(_, true): %s", err)
+			}
+
+			if pkt := e.Read(); pkt.IsNil() {
+				t.Fatalf("expected packet to be read from link endpoint")
+			} else {
+				payload := stack.PayloadSince(pkt.NetworkHeader())
+				defer payload.Release()
+				checker.IPv4(t, payload,
+					checker.SrcAddr(ipv4NICAddr),
+					checker.DstAddr(header.IPv4Broadcast),
+				)
+				pkt.DecRef()
+			}
+		})
+	}
+}
+
+func TestBroadcastUnrestricted(t *testing.T) {
+	const nicID = 1
+
+	for _, test := range []struct {
+		name         string
+		unrestricted bool
+		connect      bool
+		wantErr      tcpip.Error
+	}{
+		{
+			name:    "restricted",
+			wantErr: &tcpip.ErrBroadcastDisabled{},
+		},
+		{
+			name:    "restricted connected",
+			connect: true,
+			wantErr: &tcpip.ErrBroadcastDisabled{},
+		},
+		{
+			name:         "unrestricted",
+			unrestricted: true,
+		},
+		{
+			name:         "unrestricted connected",
+			unrestricted: true,
+			connect:      true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			link := addChannelNIC(t, s, nicID, ipv4NICAddr)
+
+			ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+			v := 0
+			if test.unrestricted {
+				v = 1
+			}
+			if err := ep.SetSockOptInt(tcpip.BroadcastUnrestrictedOption, v); err != nil {
+				t.Fatalf("ep.SetSockOptInt(tcpip.BroadcastUnrestrictedOption, %d): %s", v, err)
+			}
+			if got, err := ep.GetSockOptInt(tcpip.BroadcastUnrestrictedOption); err != nil {
+				t.Fatalf("ep.GetSockOptInt(tcpip.BroadcastUnrestrictedOption): %s", err)
+			} else if got != v {
+				t.Errorf("got ep.GetSockOptInt(tcpip.BroadcastUnrestrictedOption) = %d, want = %d", got, v)
+			}
+
+			bindAddr := tcpip.FullAddress{Addr: ipv4NICAddr}
+			if err := ep.Bind(bindAddr); err != nil {
+				t.Fatalf("ep.Bind(%#v): %s", bindAddr, err)
+			}
+
+			var writeOpts tcpip.WriteOptions
+			dst := tcpip.FullAddress{Addr: header.IPv4Broadcast}
+			if test.connect {
+				if err := ep.Connect(dst); err != nil {
+					t.Fatalf("ep.Connect(%#v): %s", dst, err)
+				}
+			} else {
+				writeOpts.To = &dst
+			}
+
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Fatalf("unexpected error from ep.AcquireContextForWrite(%#v), (-want, +got):\n%s", writeOpts, diff)
+			}
+			if err != nil {
+				return
+			}
+			defer ctx.Release()
+
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+			})
+			defer pkt.DecRef()
+			if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+				t.Fatalf("ctx.WritePacket(_, false): %s", err)
+			}
+			p := link.Read()
+			if p.IsNil() {
+				t.Fatalf("expected packet to be read from link endpoint")
+			}
+			defer p.DecRef()
+			payload := stack.PayloadSince(p.NetworkHeader())
+			defer payload.Release()
+			checker.IPv4(t, payload,
+				checker.SrcAddr(ipv4NICAddr),
+				checker.DstAddr(header.IPv4Broadcast),
+			)
+		})
+	}
+}
+
+func TestWritePacketInfoTTLAndTOS(t *testing.T) {
+	const nicID = 1
+
+	for _, test := range []struct {
+		name     string
+		netProto tcpip.NetworkProtocolNumber
+		dst      tcpip.Address
+		ttlOpt   tcpip.SockOptInt
+		tosOpt   tcpip.SockOptInt
+	}{
+		{
+			name:     "IPv4",
+			netProto: ipv4.ProtocolNumber,
+			dst:      ipv4RemoteAddr,
+			ttlOpt:   tcpip.IPv4TTLOption,
+			tosOpt:   tcpip.IPv4TOSOption,
+		},
+		{
+			name:     "IPv6",
+			netProto: ipv6.ProtocolNumber,
+			dst:      ipv6RemoteAddr,
+			ttlOpt:   tcpip.IPv6HopLimitOption,
+			tosOpt:   tcpip.IPv6TrafficClassOption,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr, ipv6NICAddr)
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+				{Destination: ipv6RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+			})
+
+			ep, _ := newEndpoint(t, s, test.netProto)
+
+			checkInfo := func(t *testing.T, writeOpts tcpip.WriteOptions, wantTTL, wantTOS uint8) {
+				t.Helper()
+
+				ctx, err := ep.AcquireContextForWrite(writeOpts)
+				if err != nil {
+					t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+				}
+				defer ctx.Release()
+				info := ctx.PacketInfo()
+				if info.TTL != wantTTL {
+					t.Errorf("got info.TTL = %d, want = %d", info.TTL, wantTTL)
+				}
+				if info.TOS != wantTOS {
+					t.Errorf("got info.TOS = %d, want = %d", info.TOS, wantTOS)
+				}
+			}
+
+			writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: test.dst}}
+			// The route's default is reported when no TTL is configured.
+			checkInfo(t, writeOpts, ipv4.DefaultTTL, 0)
+
+			const ttl, tos = 7, 0x20
+			if err := ep.SetSockOptInt(test.ttlOpt, ttl); err != nil {
+				t.Fatalf("ep.SetSockOptInt(%d, %d): %s", test.ttlOpt, ttl, err)
+			}
+			if err := ep.SetSockOptInt(test.tosOpt, tos); err != nil {
+				t.Fatalf("ep.SetSockOptInt(%d, %d): %s", test.tosOpt, tos, err)
+			}
+			checkInfo(t, writeOpts, ttl, tos)
+
+			// A per-packet TTL takes precedence over the endpoint's.
+			const cmsgTTL = 9
+			writeOpts.ControlMessages = tcpip.SendableControlMessages{
+				HasTTL:      true,
+				TTL:         cmsgTTL,
+				HasHopLimit: true,
+				HopLimit:    cmsgTTL,
+			}
+			checkInfo(t, writeOpts, cmsgTTL, tos)
+		})
+	}
+}
+
+func TestEndpointDefaultTTL(t *testing.T) {
+	const (
+		nicID        = 1
+		explicitTTL  = 7
+		endpointTTL  = 100
+		multicastTTL = 3
+	)
+
+	v4MulticastAddr := testutil.MustParse4("224.0.1.1")
+	v6MulticastAddr := testutil.MustParse6("ff0e::1")
+
+	for _, test := range []struct {
+		name        string
+		netProto    tcpip.NetworkProtocolNumber
+		ttlOpt      tcpip.SockOptInt
+		unsetTTL    int
+		dst         tcpip.Address
+		explicitTTL bool
+		endpointTTL bool
+		wantTTL     uint8
+	}{
+		{
+			name:     "IPv4 route default",
+			netProto: ipv4.ProtocolNumber,
+			ttlOpt:   tcpip.IPv4TTLOption,
+			unsetTTL: tcpip.UseDefaultIPv4TTL,
+			dst:      ipv4RemoteAddr,
+			wantTTL:  ipv4.DefaultTTL,
+		},
+		{
+			name:        "IPv4 endpoint default",
+			netProto:    ipv4.ProtocolNumber,
+			ttlOpt:      tcpip.IPv4TTLOption,
+			unsetTTL:    tcpip.UseDefaultIPv4TTL,
+			dst:         ipv4RemoteAddr,
+			endpointTTL: true,
+			wantTTL:     endpointTTL,
+		},
+		{
+			name:        "IPv4 explicit",
+			netProto:    ipv4.ProtocolNumber,
+			ttlOpt:      tcpip.IPv4TTLOption,
+			unsetTTL:    tcpip.UseDefaultIPv4TTL,
+			dst:         ipv4RemoteAddr,
+			explicitTTL: true,
+			endpointTTL: true,
+			wantTTL:     explicitTTL,
+		},
+		{
+			name:        "IPv4 multicast",
+			netProto:    ipv4.ProtocolNumber,
+			ttlOpt:      tcpip.IPv4TTLOption,
+			unsetTTL:    tcpip.UseDefaultIPv4TTL,
+			dst:         v4MulticastAddr,
+			explicitTTL: true,
+			endpointTTL: true,
+			wantTTL:     multicastTTL,
+		},
+		{
+			name:     "IPv6 route default",
+			netProto: ipv6.ProtocolNumber,
+			ttlOpt:   tcpip.IPv6HopLimitOption,
+			unsetTTL: tcpip.UseDefaultIPv6HopLimit,
+			dst:      ipv6RemoteAddr,
+			wantTTL:  ipv6.DefaultTTL,
+		},
+		{
+			name:        "IPv6 endpoint default",
+			netProto:    ipv6.ProtocolNumber,
+			ttlOpt:      tcpip.IPv6HopLimitOption,
+			unsetTTL:    tcpip.UseDefaultIPv6HopLimit,
+			dst:         ipv6RemoteAddr,
+			endpointTTL: true,
+			wantTTL:     endpointTTL,
+		},
+		{
+			name:        "IPv6 explicit",
+			netProto:    ipv6.ProtocolNumber,
+			ttlOpt:      tcpip.IPv6HopLimitOption,
+			unsetTTL:    tcpip.UseDefaultIPv6HopLimit,
+			dst:         ipv6RemoteAddr,
+			explicitTTL: true,
+			endpointTTL: true,
+			wantTTL:     explicitTTL,
+		},
+		{
+			name:        "IPv6 multicast",
+			netProto:    ipv6.ProtocolNumber,
+			ttlOpt:      tcpip.IPv6HopLimitOption,
+			unsetTTL:    tcpip.UseDefaultIPv6HopLimit,
+			dst:         v6MulticastAddr,
+			explicitTTL: true,
+			endpointTTL: true,
+			wantTTL:     multicastTTL,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr, ipv6NICAddr)
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: header.IPv4EmptySubnet, NIC: nicID},
+				{Destination: header.IPv6EmptySubnet, NIC: nicID},
+			})
+
+			ep, _ := newEndpoint(t, s, test.netProto)
+
+			if err := ep.SetSockOptInt(tcpip.MulticastTTLOption, multicastTTL); err != nil {
+				t.Fatalf("ep.SetSockOptInt(tcpip.MulticastTTLOption, %d): %s", multicastTTL, err)
+			}
+			if test.endpointTTL {
+				if err := ep.SetSockOptInt(tcpip.EndpointDefaultTTLOption, endpointTTL); err != nil {
+					t.Fatalf("ep.SetSockOptInt(tcpip.EndpointDefaultTTLOption, %d): %s", endpointTTL, err)
+				}
+			}
+			if test.explicitTTL {
+				if err := ep.SetSockOptInt(test.ttlOpt, explicitTTL); err != nil {
+					t.Fatalf("ep.SetSockOptInt(%d, %d): %s", test.ttlOpt, explicitTTL, err)
+				}
+			}
+
+			checkTTL := func(want uint8) {
+				t.Helper()
+				writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: test.dst}}
+				ctx, err := ep.AcquireContextForWrite(writeOpts)
+				if err != nil {
+					t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+				}
+				defer ctx.Release()
+				if got := ctx.PacketInfo().TTL; got != want {
+					t.Errorf("got ctx.PacketInfo().TTL = %d, want = %d", got, want)
+				}
+			}
+			checkTTL(test.wantTTL)
+
+			// Clearing the explicit TTL falls back to the endpoint's default, if
+			// any, rather than the route's.
+			if !test.explicitTTL || header.IsV4MulticastAddress(test.dst) || header.IsV6MulticastAddress(test.dst) {
+				return
+			}
+			if err := ep.SetSockOptInt(test.ttlOpt, test.unsetTTL); err != nil {
+				t.Fatalf("ep.SetSockOptInt(%d, %d): %s", test.ttlOpt, test.unsetTTL, err)
+			}
+			checkTTL(endpointTTL)
+		})
+	}
+}
+
+func TestEndpointDefaultTTLInvalid(t *testing.T) {
+	s := newStack(t, ipv4.NewProtocol)
+
+	ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+	for _, v := range []int{-1, math.MaxUint8 + 1} {
+		if diff := cmp.Diff(&tcpip.ErrInvalidOptionValue{}, ep.SetSockOptInt(tcpip.EndpointDefaultTTLOption, v)); diff != "" {
+			t.Errorf("ep.SetSockOptInt(tcpip.EndpointDefaultTTLOption, %d) error mismatch (-want +got):\n%s", v, diff)
+		}
+	}
+	if v, err := ep.GetSockOptInt(tcpip.EndpointDefaultTTLOption); err != nil {
+		t.Fatalf("ep.GetSockOptInt(tcpip.EndpointDefaultTTLOption): %s", err)
+	} else if v != 0 {
+		t.Errorf("got ep.GetSockOptInt(tcpip.EndpointDefaultTTLOption) = %d, want = 0", v)
+	}
+}
+
+func TestECN(t *testing.T) {
+	const (
+		nicID = 1
+		// DSCP 46 (expedited forwarding) with the ECT(1) codepoint.
+		stickyTOS = 0xb9
+	)
+
+	for _, netTest := range []struct {
+		name      string
+		netProto  tcpip.NetworkProtocolNumber
+		tosOpt    tcpip.SockOptInt
+		dst       tcpip.Address
+		checkerFn func(*testing.T, *buffer.View, ...checker.NetworkChecker)
+	}{
+		{
+			name:      "IPv4",
+			netProto:  ipv4.ProtocolNumber,
+			tosOpt:    tcpip.IPv4TOSOption,
+			dst:       ipv4RemoteAddr,
+			checkerFn: checker.IPv4,
+		},
+		{
+			name:      "IPv6",
+			netProto:  ipv6.ProtocolNumber,
+			tosOpt:    tcpip.IPv6TrafficClassOption,
+			dst:       ipv6RemoteAddr,
+			checkerFn: checker.IPv6,
+		},
+	} {
+		for _, test := range []struct {
+			name    string
+			ecn     int
+			wantTOS uint8
+		}{
+			{name: "from TOS", ecn: tcpip.ECNFromTOS, wantTOS: 0xb9},
+			{name: "Not-ECT", ecn: tcpip.ECNNotECT, wantTOS: 0xb8},
+			{name: "ECT(0)", ecn: tcpip.ECNECT0, wantTOS: 0xba},
+			{name: "ECT(1)", ecn: tcpip.ECNECT1, wantTOS: 0xb9},
+		} {
+			t.Run(fmt.Sprintf("%s %s", netTest.name, test.name), func(t *testing.T) {
+				s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+				e := addChannelNIC(t, s, nicID, ipv4NICAddr, ipv6NICAddr)
+				s.SetRouteTable([]tcpip.Route{
+					{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+					{Destination: ipv6RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+				})
+
+				ep, _ := newEndpoint(t, s, netTest.netProto)
+				if err := ep.SetSockOptInt(netTest.tosOpt, stickyTOS); err != nil {
+					t.Fatalf("ep.SetSockOptInt(%d, %d): %s", netTest.tosOpt, stickyTOS, err)
+				}
+				if err := ep.SetSockOptInt(tcpip.ECNOption, test.ecn); err != nil {
+					t.Fatalf("ep.SetSockOptInt(tcpip.ECNOption, %d): %s", test.ecn, err)
+				}
+				if v, err := ep.GetSockOptInt(tcpip.ECNOption); err != nil {
+					t.Fatalf("ep.GetSockOptInt(tcpip.ECNOption): %s", err)
+				} else if v != test.ecn {
+					t.Errorf("got ep.GetSockOptInt(tcpip.ECNOption) = %d, want = %d", v, test.ecn)
+				}
+
+				writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: netTest.dst}}
+				ctx, err := ep.AcquireContextForWrite(writeOpts)
+				if err != nil {
+					t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+				}
+				defer ctx.Release()
+
+				pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+					ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+				})
+				defer pkt.DecRef()
+				if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+					t.Fatalf("ctx.WritePacket(_, false): %s", err)
+				}
+				if pkt := e.Read(); pkt.IsNil() {
+					t.Fatalf("expected packet to be read from link endpoint")
+				} else {
+					payload := stack.PayloadSince(pkt.NetworkHeader())
+					defer payload.Release()
+					netTest.checkerFn(t, payload, checker.TOS(test.wantTOS, 0))
+					pkt.DecRef()
+				}
+
+				// The sticky TOS is kept as set.
+				if v, err := ep.GetSockOptInt(netTest.tosOpt); err != nil {
+					t.Fatalf("ep.GetSockOptInt(%d): %s", netTest.tosOpt, err)
+				} else if v != stickyTOS {
+					t.Errorf("got ep.GetSockOptInt(%d) = %#x, want = %#x", netTest.tosOpt, v, stickyTOS)
+				}
+			})
+		}
+	}
+}
+
+func TestECNInvalid(t *testing.T) {
+	s := newStack(t, ipv4.NewProtocol)
+
+	ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+	for _, v := range []int{-1, tcpip.ECNECT1 + 1} {
+		if diff := cmp.Diff(&tcpip.ErrInvalidOptionValue{}, ep.SetSockOptInt(tcpip.ECNOption, v)); diff != "" {
+			t.Errorf("ep.SetSockOptInt(tcpip.ECNOption, %d) error mismatch (-want +got):\n%s", v, diff)
+		}
+	}
+}
+
+func TestTClassControlMessage(t *testing.T) {
+	const (
+		nicID        = 1
+		stickyTClass = 0x20
+		cmsgTClass   = 0x48
+	)
+
+	v4MappedRemoteAddr := testutil.MustParse6("::ffff:0607:0809")
+
+	for _, test := range []struct {
+		name      string
+		dst       tcpip.Address
+		cmsgs     tcpip.SendableControlMessages
+		checkerFn func(*testing.T, *buffer.View, ...checker.NetworkChecker)
+		wantTOS   uint8
+	}{
+		{
+			name:      "IPv6 unset",
+			dst:       ipv6RemoteAddr,
+			checkerFn: checker.IPv6,
+			wantTOS:   stickyTClass,
+		},
+		{
+			name:      "IPv6 override",
+			dst:       ipv6RemoteAddr,
+			cmsgs:     tcpip.SendableControlMessages{HasTClass: true, TClass: cmsgTClass},
+			checkerFn: checker.IPv6,
+			wantTOS:   cmsgTClass,
+		},
+		{
+			name:      "IPv4-mapped ignores override",
+			dst:       v4MappedRemoteAddr,
+			cmsgs:     tcpip.SendableControlMessages{HasTClass: true, TClass: cmsgTClass},
+			checkerFn: checker.IPv4,
+			wantTOS:   0,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+			e := addChannelNIC(t, s, nicID, ipv4NICAddr, ipv6NICAddr)
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+				{Destination: ipv6RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+			})
+
+			ep, _ := newEndpoint(t, s, ipv6.ProtocolNumber)
+			if err := ep.SetSockOptInt(tcpip.IPv6TrafficClassOption, stickyTClass); err != nil {
+				t.Fatalf("ep.SetSockOptInt(tcpip.IPv6TrafficClassOption, %d): %s", stickyTClass, err)
+			}
+
+			writeOpts := tcpip.WriteOptions{
+				To:              &tcpip.FullAddress{Addr: test.dst},
+				ControlMessages: test.cmsgs,
+			}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if err != nil {
+				t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+			}
+			defer ctx.Release()
+			if got := ctx.PacketInfo().TOS; got != test.wantTOS {
+				t.Errorf("got ctx.PacketInfo().TOS = %d, want = %d", got, test.wantTOS)
+			}
+
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+			})
+			defer pkt.DecRef()
+			if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+				t.Fatalf("ctx.WritePacket(_, false): %s", err)
+			}
+			if pkt := e.Read(); pkt.IsNil() {
+				t.Fatalf("expected packet to be read from link endpoint")
+			} else {
+				payload := stack.PayloadSince(pkt.NetworkHeader())
+				defer payload.Release()
+				test.checkerFn(t, payload, checker.TOS(test.wantTOS, 0))
+				pkt.DecRef()
+			}
+		})
+	}
+}
+
+func TestDontFragment(t *testing.T) {
+	const nicID = 1
+
+	for _, test := range []struct {
+		name     string
+		netProto tcpip.NetworkProtocolNumber
+		dst      tcpip.Address
+		checker  func(*testing.T, *buffer.View)
+	}{
+		{
+			name:     "IPv4",
+			netProto: ipv4.ProtocolNumber,
+			dst:      ipv4RemoteAddr,
+			checker: func(t *testing.T, v *buffer.View) {
+				checker.IPv4(t, v, checker.FragmentFlags(header.IPv4FlagDontFragment))
+			},
+		},
+		{
+			name:     "IPv6",
+			netProto: ipv6.ProtocolNumber,
+			dst:      ipv6RemoteAddr,
+			checker: func(t *testing.T, v *buffer.View) {
+				checker.IPv6(t, v, checker.DstAddr(ipv6RemoteAddr))
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+			e := addChannelNIC(t, s, nicID, ipv4NICAddr, ipv6NICAddr)
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+				{Destination: ipv6RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+			})
+
+			ep, _ := newEndpoint(t, s, test.netProto)
+
+			write := func(t *testing.T, payloadSize int) tcpip.Error {
+				t.Helper()
+
+				writeOpts := tcpip.WriteOptions{
+					To:           &tcpip.FullAddress{Addr: test.dst},
+					DontFragment: true,
+				}
+				ctx, err := ep.AcquireContextForWrite(writeOpts)
+				if err != nil {
+					t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+				}
+				defer ctx.Release()
+				pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+					ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+					Payload:            buffer.MakeWithData(make([]byte, payloadSize)),
+				})
+				defer pkt.DecRef()
+				return ctx.WritePacket(pkt, false /* headerIncluded */)
+			}
+
+			if err := write(t, 100); err != nil {
+				t.Fatalf("write(_, 100): %s", err)
+			}
+			if pkt := e.Read(); pkt.IsNil() {
+				t.Fatalf("expected packet to be read from link endpoint")
+			} else {
+				payload := stack.PayloadSince(pkt.NetworkHeader())
+				defer payload.Release()
+				test.checker(t, payload)
+				pkt.DecRef()
+			}
+
+			// Packets larger than the MTU are not fragmented.
+			oversize := int(e.MTU()) + 1
+			if diff := cmp.Diff(&tcpip.ErrMessageTooLong{}, write(t, oversize)); diff != "" {
+				t.Errorf("unexpected error from write(_, %d), (-want, +got):\n%s", oversize, diff)
+			}
+			if pkt := e.Read(); !pkt.IsNil() {
+				pkt.DecRef()
+				t.Errorf("unexpected packet read from link endpoint")
+			}
+		})
+	}
+}
+
+func TestIPv4IDOverride(t *testing.T) {
+	const (
+		nicID = 1
+		id    = 0x1234
+	)
+
+	s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+	e := addChannelNIC(t, s, nicID, ipv4NICAddr, ipv6NICAddr)
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+		{Destination: ipv6RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+	})
+
+	ep, _ := newEndpoint(t, s, ipv6.ProtocolNumber)
+
+	// The ID is used for every write that carries it, rather than an ID
+	// allocated by the stack.
+	v4MappedRemoteAddr := testutil.MustParse6("::ffff:0607:0809")
+	for i := 0; i < 2; i++ {
+		writeOpts := tcpip.WriteOptions{
+			To:        &tcpip.FullAddress{Addr: v4MappedRemoteAddr},
+			HasIPv4ID: true,
+			IPv4ID:    id,
+		}
+		ctx, err := ep.AcquireContextForWrite(writeOpts)
+		if err != nil {
+			t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+		}
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+		})
+		err = ctx.WritePacket(pkt, false /* headerIncluded */)
+		pkt.DecRef()
+		ctx.Release()
+		if err != nil {
+			t.Fatalf("ctx.WritePacket(_, false): %s", err)
+		}
+
+		pkt = e.Read()
+		if pkt.IsNil() {
+			t.Fatalf("expected packet to be read from link endpoint")
+		}
+		payload := stack.PayloadSince(pkt.NetworkHeader())
+		checker.IPv4(t, payload, checker.DstAddr(ipv4RemoteAddr))
+		if got := header.IPv4(payload.AsSlice()).ID(); got != id {
+			t.Errorf("got write #%d IPv4 ID = %#x, want = %#x", i, got, id)
+		}
+		payload.Release()
+		pkt.DecRef()
+	}
+
+	// IPv6 headers have no identification field.
+	writeOpts := tcpip.WriteOptions{
+		To:        &tcpip.FullAddress{Addr: ipv6RemoteAddr},
+		HasIPv4ID: true,
+		IPv4ID:    id,
+	}
+	if _, err := ep.AcquireContextForWrite(writeOpts); err == nil {
+		t.Fatalf("ep.AcquireContextForWrite(%#v) unexpectedly succeeded", writeOpts)
+	} else if diff := cmp.Diff(&tcpip.ErrInvalidOptionValue{}, err); diff != "" {
+		t.Errorf("ep.AcquireContextForWrite(%#v) error mismatch (-want +got):\n%s", writeOpts, diff)
+	}
+}
+
+func TestWritePackets(t *testing.T) {
+	const (
+		nicID = 1
+		mtu   = header.IPv6MinimumMTU
+	)
+
+	s := newStack(t, ipv4.NewProtocol)
+	e := addChannelNIC(t, s, nicID, ipv4NICAddr)
+	s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID}})
+
+	ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+	connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+	if err := ep.Connect(connectAddr); err != nil {
+		t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+	}
+
+	for _, test := range []struct {
+		name         string
+		payloadSizes []int
+		wantN        int
+		wantErr      tcpip.Error
+	}{
+		{
+			name:         "all written",
+			payloadSizes: []int{10, 20, 30},
+			wantN:        3,
+		},
+		{
+			name:         "partial failure",
+			payloadSizes: []int{10, mtu, 30},
+			wantN:        1,
+			wantErr:      &tcpip.ErrMessageTooLong{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// Don't fragment makes the oversized packet fail to be written.
+			writeOpts := tcpip.WriteOptions{DontFragment: true}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if err != nil {
+				t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+			}
+			defer ctx.Release()
+
+			var pkts []stack.PacketBufferPtr
+			for _, size := range test.payloadSizes {
+				pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+					ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+					Payload:            buffer.MakeWithData(make([]byte, size)),
+				})
+				defer pkt.DecRef()
+				pkts = append(pkts, pkt)
+			}
+
+			n, err := ctx.WritePackets(pkts, false /* headerIncluded */)
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Errorf("ctx.WritePackets(_, false) error mismatch (-want +got):\n%s", diff)
+			}
+			if n != test.wantN {
+				t.Errorf("got ctx.WritePackets(_, false) = %d, want = %d", n, test.wantN)
+			}
+
+			// Packets after the failing one are not written.
+			for i := 0; i < test.wantN; i++ {
+				pkt := e.Read()
+				if pkt.IsNil() {
+					t.Fatalf("expected packet #%d to be read from link endpoint", i)
+				}
+				payload := stack.PayloadSince(pkt.NetworkHeader())
+				checker.IPv4(t, payload, checker.PayloadLen(test.payloadSizes[i]))
+				payload.Release()
+				pkt.DecRef()
+			}
+			if pkt := e.Read(); !pkt.IsNil() {
+				pkt.DecRef()
+				t.Errorf("unexpected packet read from link endpoint")
+			}
+		})
+	}
+}
+
+// BenchmarkConnectedWrite measures writing bursts of packets from a connected
+// endpoint with a write context per packet and with a single write context.
+func BenchmarkConnectedWrite(b *testing.B) {
+	const (
+		nicID     = 1
+		burstSize = 16
+	)
+
+	for _, batched := range []bool{false, true} {
+		b.Run(fmt.Sprintf("batched=%t", batched), func(b *testing.B) {
+			s := newStack(b, ipv4.NewProtocol)
+			// A zero length queue drops every packet written.
+			if err := s.CreateNIC(nicID, channel.New(0, header.IPv6MinimumMTU, "")); err != nil {
+				b.Fatalf("s.CreateNIC(%d, _): %s", nicID, err)
+			}
+			protocolAddr := tcpip.ProtocolAddress{
+				Protocol:          ipv4.ProtocolNumber,
+				AddressWithPrefix: ipv4NICAddr.WithPrefix(),
+			}
+			if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+				b.Fatalf("s.AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+			}
+			s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+			ep, _ := newEndpoint(b, s, ipv4.ProtocolNumber)
+			connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+			if err := ep.Connect(connectAddr); err != nil {
+				b.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+			}
+
+			newPacket := func(ctx *network.WriteContext) stack.PacketBufferPtr {
+				return stack.NewPacketBuffer(stack.PacketBufferOptions{
+					ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+				})
+			}
+			pkts := make([]stack.PacketBufferPtr, burstSize)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if batched {
+					ctx, err := ep.AcquireContextForWrite(tcpip.WriteOptions{})
+					if err != nil {
+						b.Fatalf("ep.AcquireContextForWrite({}): %s", err)
+					}
+					for j := range pkts {
+						pkts[j] = newPacket(&ctx)
+					}
+					if _, err := ctx.WritePackets(pkts, false /* headerIncluded */); err != nil {
+						b.Fatalf("ctx.WritePackets(_, false): %s", err)
+					}
+					for _, pkt := range pkts {
+						pkt.DecRef()
+					}
+					ctx.Release()
+					continue
+				}
+
+				for j := 0; j < burstSize; j++ {
+					ctx, err := ep.AcquireContextForWrite(tcpip.WriteOptions{})
+					if err != nil {
+						b.Fatalf("ep.AcquireContextForWrite({}): %s", err)
+					}
+					pkt := newPacket(&ctx)
+					if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+						b.Fatalf("ctx.WritePacket(_, false): %s", err)
+					}
+					pkt.DecRef()
+					ctx.Release()
+				}
+			}
+		})
+	}
+}
+
+func TestPathMTU(t *testing.T) {
+	const nicID = 1
+
+	s := newStack(t, ipv4.NewProtocol)
+	addChannelNIC(t, s, nicID, ipv4NICAddr)
+	s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID}})
+
+	ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+	var got []uint32
+	ep.SetMTUChangeHandler(func(mtu uint32) {
+		// The handler is called without the endpoint's lock held.
+		if pathMTU := ep.PathMTU(); pathMTU != mtu {
+			t.Errorf("got ep.PathMTU() = %d from handler, want = %d", pathMTU, mtu)
+		}
+		got = append(got, mtu)
+	})
+
+	checkPathMTU := func(want uint32, wantCalls []uint32) {
+		t.Helper()
+		if pathMTU := ep.PathMTU(); pathMTU != want {
+			t.Errorf("got ep.PathMTU() = %d, want = %d", pathMTU, want)
+		}
+		if diff := cmp.Diff(wantCalls, got); diff != "" {
+			t.Errorf("MTU change handler calls mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	// Unconnected endpoints have no path MTU.
+	ep.HandlePacketTooBig(1000)
+	checkPathMTU(0, nil)
+
+	connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+	if err := ep.Connect(connectAddr); err != nil {
+		t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+	}
+	routeMTU := uint32(header.IPv6MinimumMTU - header.IPv4MinimumSize)
+	checkPathMTU(routeMTU, nil)
+
+	ep.HandlePacketTooBig(1000)
+	checkPathMTU(1000, []uint32{1000})
+
+	// Larger MTUs do not raise the path MTU.
+	ep.HandlePacketTooBig(1100)
+	ep.HandlePacketTooBig(routeMTU + 100)
+	checkPathMTU(1000, []uint32{1000})
+
+	ep.HandlePacketTooBig(900)
+	checkPathMTU(900, []uint32{1000, 900})
+
+	// Connecting again starts from the route's MTU.
+	if err := ep.Connect(connectAddr); err != nil {
+		t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+	}
+	checkPathMTU(routeMTU, []uint32{1000, 900})
+
+	ep.Disconnect()
+	ep.HandlePacketTooBig(800)
+	checkPathMTU(0, []uint32{1000, 900})
+}
+
+func TestFloatingSource(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	nic2Addr := testutil.MustParse4("2.3.4.5")
+
+	for _, test := range []struct {
+		name          string
+		floating      bool
+		wantLocalAddr tcpip.Address
+		wantNICID     tcpip.NICID
+		wantSrc       tcpip.Address
+	}{
+		{
+			name:          "pinned",
+			floating:      false,
+			wantLocalAddr: ipv4NICAddr,
+			wantNICID:     nicID1,
+			wantSrc:       ipv4NICAddr,
+		},
+		{
+			name:          "floating",
+			floating:      true,
+			wantLocalAddr: tcpip.Address{},
+			wantNICID:     nicID2,
+			wantSrc:       nic2Addr,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			links := map[tcpip.NICID]*channel.Endpoint{
+				nicID1: addChannelNIC(t, s, nicID1, ipv4NICAddr),
+				nicID2: addChannelNIC(t, s, nicID2, nic2Addr),
+			}
+			s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID1}})
+
+			ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+			v := 0
+			if test.floating {
+				v = 1
+			}
+			if err := ep.SetSockOptInt(tcpip.FloatingSourceOption, v); err != nil {
+				t.Fatalf("ep.SetSockOptInt(tcpip.FloatingSourceOption, %d): %s", v, err)
+			}
+			connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+			if err := ep.Connect(connectAddr); err != nil {
+				t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+			}
+			if diff := cmp.Diff(tcpip.FullAddress{Addr: test.wantLocalAddr}, ep.GetLocalAddress()); diff != "" {
+				t.Errorf("ep.GetLocalAddress() mismatch (-want +got):\n%s", diff)
+			}
+
+			checkSend := func(t *testing.T, wantNICID tcpip.NICID, wantSrc tcpip.Address) {
+				t.Helper()
+
+				ctx, err := ep.AcquireContextForWrite(tcpip.WriteOptions{})
+				if err != nil {
+					t.Fatalf("ep.AcquireContextForWrite({}): %s", err)
+				}
+				defer ctx.Release()
+				pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+					ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+				})
+				defer pkt.DecRef()
+				if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+					t.Fatalf("ctx.WritePacket(_, false): %s", err)
+				}
+				for nicID, e := range links {
+					pkt := e.Read()
+					if got, want := !pkt.IsNil(), nicID == wantNICID; got != want {
+						t.Fatalf("got packet read from NIC %d = %t, want = %t", nicID, got, want)
+					}
+					if pkt.IsNil() {
+						continue
+					}
+					payload := stack.PayloadSince(pkt.NetworkHeader())
+					checker.IPv4(t, payload, checker.SrcAddr(wantSrc), checker.DstAddr(ipv4RemoteAddr))
+					payload.Release()
+					pkt.DecRef()
+				}
+			}
+
+			checkSend(t, nicID1, ipv4NICAddr)
+
+			// Only an endpoint with a floating source follows the route change.
+			s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID2}})
+			checkSend(t, test.wantNICID, test.wantSrc)
+		})
+	}
+}
+
+func TestPreferredSource(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	nic1SecondaryAddr := testutil.MustParse4("1.2.3.5")
+	nic2Addr := testutil.MustParse4("2.3.4.5")
+
+	for _, test := range []struct {
+		name      string
+		preferred tcpip.Address
+		wantSrc   tcpip.Address
+	}{
+		{
+			name:    "unset",
+			wantSrc: ipv4NICAddr,
+		},
+		{
+			name:      "primary",
+			preferred: ipv4NICAddr,
+			wantSrc:   ipv4NICAddr,
+		},
+		{
+			name:      "secondary",
+			preferred: nic1SecondaryAddr,
+			wantSrc:   nic1SecondaryAddr,
+		},
+		{
+			name:      "other NIC",
+			preferred: nic2Addr,
+			wantSrc:   ipv4NICAddr,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			e := addChannelNIC(t, s, nicID1, ipv4NICAddr, nic1SecondaryAddr)
+			addChannelNIC(t, s, nicID2, nic2Addr)
+			s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID1}})
+
+			ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+			opt := tcpip.PreferredSourceOption(test.preferred)
+			if err := ep.SetSockOpt(&opt); err != nil {
+				t.Fatalf("ep.SetSockOpt(&%#v): %s", opt, err)
+			}
+			var got tcpip.PreferredSourceOption
+			if err := ep.GetSockOpt(&got); err != nil {
+				t.Fatalf("ep.GetSockOpt(_): %s", err)
+			}
+			if diff := cmp.Diff(test.preferred, tcpip.Address(got)); diff != "" {
+				t.Errorf("ep.GetSockOpt(_) mismatch (-want +got):\n%s", diff)
+			}
+
+			writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: ipv4RemoteAddr}}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if err != nil {
+				t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+			}
+			defer ctx.Release()
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+			})
+			defer pkt.DecRef()
+			if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+				t.Fatalf("ctx.WritePacket(_, false): %s", err)
+			}
+			if pkt := e.Read(); pkt.IsNil() {
+				t.Fatalf("expected packet to be read from link endpoint")
+			} else {
+				payload := stack.PayloadSince(pkt.NetworkHeader())
+				defer payload.Release()
+				checker.IPv4(t, payload, checker.SrcAddr(test.wantSrc), checker.DstAddr(ipv4RemoteAddr))
+				pkt.DecRef()
+			}
+
+			// The preference also selects the address a connected endpoint is
+			// registered with.
+			connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+			if err := ep.Connect(connectAddr); err != nil {
+				t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+			}
+			if diff := cmp.Diff(tcpip.FullAddress{Addr: test.wantSrc}, ep.GetLocalAddress()); diff != "" {
+				t.Errorf("ep.GetLocalAddress() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPreferredSourceInvalid(t *testing.T) {
+	const nicID = 1
+
+	s := newStack(t, ipv4.NewProtocol)
+	addChannelNIC(t, s, nicID, ipv4NICAddr)
+
+	ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+	for _, addr := range []tcpip.Address{ipv4RemoteAddr, header.IPv4AllSystems, header.IPv4Broadcast} {
+		opt := tcpip.PreferredSourceOption(addr)
+		if diff := cmp.Diff(&tcpip.ErrBadLocalAddress{}, ep.SetSockOpt(&opt)); diff != "" {
+			t.Errorf("ep.SetSockOpt(&%#v) error mismatch (-want +got):\n%s", opt, diff)
+		}
+	}
+}
+
+func TestClone(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	nic2Addr := testutil.MustParse4("2.3.4.5")
+	group := header.IPv4AllRoutersGroup
+
+	newStackWithNICs := func(t *testing.T) *stack.Stack {
+		s := newStack(t, ipv4.NewProtocol)
+		addChannelNIC(t, s, nicID1, ipv4NICAddr)
+		addChannelNIC(t, s, nicID2, nic2Addr)
+		return s
+	}
+
+	checkInGroup := func(t *testing.T, s *stack.Stack, nicID tcpip.NICID, want bool) {
+		t.Helper()
+
+		if joined, err := s.IsInGroup(nicID, group); err != nil {
+			t.Fatalf("s.IsInGroup(%d, %s): %s", nicID, group, err)
+		} else if joined != want {
+			t.Errorf("got s.IsInGroup(%d, %s) = %t, want = %t", nicID, group, joined, want)
+		}
+	}
+
+	joinGroup := func(t *testing.T, ep *network.Endpoint, nicID tcpip.NICID) {
+		t.Helper()
+
+		memOpt := tcpip.AddMembershipOption{NIC: nicID, MulticastAddr: group}
+		if err := ep.SetSockOpt(&memOpt); err != nil {
+			t.Fatalf("ep.SetSockOpt(&%#v): %s", memOpt, err)
+		}
+	}
+
+	t.Run("copies options and memberships", func(t *testing.T) {
+		s := newStackWithNICs(t)
+
+		ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+		intOpts := map[tcpip.SockOptInt]int{
+			tcpip.IPv4TTLOption:              7,
+			tcpip.IPv4TOSOption:              0x20,
+			tcpip.MulticastTTLOption:         3,
+			tcpip.MulticastAllOption:         0,
+			tcpip.UnicastInterfaceOption:     nicID2,
+			tcpip.IPv6UnicastInterfaceOption: nicID1,
+		}
+		for opt, v := range intOpts {
+			if err := ep.SetSockOptInt(opt, v); err != nil {
+				t.Fatalf("ep.SetSockOptInt(%d, %d): %s", opt, v, err)
+			}
+		}
+		ifOpt := tcpip.MulticastInterfaceOption{NIC: nicID1}
+		if err := ep.SetSockOpt(&ifOpt); err != nil {
+			t.Fatalf("ep.SetSockOpt(&%#v): %s", ifOpt, err)
+		}
+		joinGroup(t, ep, nicID1)
+		connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+		s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID2}})
+		if err := ep.Connect(connectAddr); err != nil {
+			t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+		}
+
+		var cloneOps tcpip.SocketOptions
+		var clone network.Endpoint
+		var cloneWQ waiter.Queue
+		if err := ep.Clone(&clone, &cloneOps, &cloneWQ); err != nil {
+			t.Fatalf("ep.Clone(_, _, _): %s", err)
+		}
+		defer clone.Close()
+
+		if state := clone.State(); state != transport.DatagramEndpointStateInitial {
+			t.Errorf("got clone.State() = %s, want = %s", state, transport.DatagramEndpointStateInitial)
+		}
+		for opt, want := range intOpts {
+			if got, err := clone.GetSockOptInt(opt); err != nil {
+				t.Fatalf("clone.GetSockOptInt(%d): %s", opt, err)
+			} else if got != want {
+				t.Errorf("got clone.GetSockOptInt(%d) = %d, want = %d", opt, got, want)
+			}
+		}
+		var gotIfOpt tcpip.MulticastInterfaceOption
+		if err := clone.GetSockOpt(&gotIfOpt); err != nil {
+			t.Fatalf("clone.GetSockOpt(_): %s", err)
+		}
+		if diff := cmp.Diff(ifOpt, gotIfOpt); diff != "" {
+			t.Errorf("multicast interface mismatch (-want +got):\n%s", diff)
+		}
+
+		// The clone's membership is independent of the original's.
+		ep.Close()
+		checkInGroup(t, s, nicID1, true)
+		clone.Close()
+		checkInGroup(t, s, nicID1, false)
+	})
+
+	t.Run("rolls back memberships on failure", func(t *testing.T) {
+		s := newStackWithNICs(t)
+
+		ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+		joinGroup(t, ep, nicID1)
+		joinGroup(t, ep, nicID2)
+		if err := s.RemoveNIC(nicID2); err != nil {
+			t.Fatalf("s.RemoveNIC(%d): %s", nicID2, err)
+		}
+
+		var cloneOps tcpip.SocketOptions
+		var clone network.Endpoint
+		var cloneWQ waiter.Queue
+		if err := ep.Clone(&clone, &cloneOps, &cloneWQ); err == nil {
+			t.Fatal("got ep.Clone(_, _, _) = nil, want non-nil")
+		}
+		if state := clone.State(); state != transport.DatagramEndpointStateClosed {
+			t.Errorf("got clone.State() = %s, want = %s", state, transport.DatagramEndpointStateClosed)
+		}
+
+		// Only the original endpoint's membership remains.
+		ep.Close()
+		checkInGroup(t, s, nicID1, false)
+	})
+
+	t.Run("closed endpoint", func(t *testing.T) {
+		s := newStackWithNICs(t)
+
+		ep, ops := newEndpoint(t, s, ipv4.ProtocolNumber)
+		ep.Close()
+
+		var clone network.Endpoint
+		err := ep.Clone(&clone, ops, &waiter.Queue{})
+		if diff := cmp.Diff(&tcpip.ErrInvalidEndpointState{}, err); diff != "" {
+			t.Errorf("unexpected error from ep.Clone(_, _, _), (-want, +got):\n%s", diff)
+		}
+	})
+}
+
+func TestMulticastMembershipPerNIC(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	group := header.IPv4AllRoutersGroup
+
+	s := newStack(t, ipv4.NewProtocol)
+	addChannelNIC(t, s, nicID1, ipv4NICAddr)
+	addChannelNIC(t, s, nicID2, testutil.MustParse4("2.3.4.5"))
+
+	ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+	checkInGroup := func(t *testing.T, nicID tcpip.NICID, want bool) {
+		t.Helper()
+
+		if joined, err := s.IsInGroup(nicID, group); err != nil {
+			t.Fatalf("s.IsInGroup(%d, %s): %s", nicID, group, err)
+		} else if joined != want {
+			t.Errorf("got s.IsInGroup(%d, %s) = %t, want = %t", nicID, group, joined, want)
+		}
+	}
+
+	for _, nicID := range []tcpip.NICID{nicID1, nicID2} {
+		memOpt := tcpip.AddMembershipOption{NIC: nicID, MulticastAddr: group}
+		if err := ep.SetSockOpt(&memOpt); err != nil {
+			t.Fatalf("ep.SetSockOpt(&%#v): %s", memOpt, err)
+		}
+	}
+	checkInGroup(t, nicID1, true)
+	checkInGroup(t, nicID2, true)
+
+	// Only joining again on the same NIC conflicts.
+	memOpt := tcpip.AddMembershipOption{NIC: nicID1, MulticastAddr: group}
+	if diff := cmp.Diff(&tcpip.ErrPortInUse{}, ep.SetSockOpt(&memOpt)); diff != "" {
+		t.Errorf("unexpected error from ep.SetSockOpt(&%#v), (-want, +got):\n%s", memOpt, diff)
+	}
+
+	// Removing the membership on one NIC leaves the other.
+	removeOpt := tcpip.RemoveMembershipOption{NIC: nicID1, MulticastAddr: group}
+	if err := ep.SetSockOpt(&removeOpt); err != nil {
+		t.Fatalf("ep.SetSockOpt(&%#v): %s", removeOpt, err)
+	}
+	checkInGroup(t, nicID1, false)
+	checkInGroup(t, nicID2, true)
+	if diff := cmp.Diff(&tcpip.ErrBadLocalAddress{}, ep.SetSockOpt(&removeOpt)); diff != "" {
+		t.Errorf("unexpected error from ep.SetSockOpt(&%#v), (-want, +got):\n%s", removeOpt, diff)
+	}
+
+	// The remaining membership is released when the endpoint is closed.
+	ep.Close()
+	checkInGroup(t, nicID2, false)
+}
+
+func TestBulkMembership(t *testing.T) {
+	const (
+		nicID        = 1
+		unknownNICID = 2
+	)
+
+	groups := []tcpip.Address{
+		testutil.MustParse4("224.0.1.1"),
+		testutil.MustParse4("224.0.1.2"),
+		testutil.MustParse4("224.0.1.3"),
+	}
+
+	s := newStack(t, ipv4.NewProtocol)
+	addChannelNIC(t, s, nicID, ipv4NICAddr)
+
+	ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+	checkInGroups := func(t *testing.T, want bool) {
+		t.Helper()
+
+		for _, group := range groups {
+			if joined, err := s.IsInGroup(nicID, group); err != nil {
+				t.Fatalf("s.IsInGroup(%d, %s): %s", nicID, group, err)
+			} else if joined != want {
+				t.Errorf("got s.IsInGroup(%d, %s) = %t, want = %t", nicID, group, joined, want)
+			}
+		}
+	}
+
+	var mems []tcpip.MembershipOption
+	for _, group := range groups {
+		mems = append(mems, tcpip.MembershipOption{NIC: nicID, MulticastAddr: group})
+	}
+
+	// A failure midway through the list leaves none of the groups joined.
+	failingAddOpt := tcpip.AddMembershipsOption(append(append([]tcpip.MembershipOption(nil), mems...), tcpip.MembershipOption{NIC: unknownNICID, MulticastAddr: groups[0]}))
+	if diff := cmp.Diff(&tcpip.ErrUnknownNICID{}, ep.SetSockOpt(&failingAddOpt)); diff != "" {
+		t.Errorf("unexpected error from ep.SetSockOpt(&%#v), (-want, +got):\n%s", failingAddOpt, diff)
+	}
+	checkInGroups(t, false)
+
+	// Identifying the same membership twice is invalid.
+	duplicateAddOpt := tcpip.AddMembershipsOption{mems[0], mems[0]}
+	if diff := cmp.Diff(&tcpip.ErrInvalidOptionValue{}, ep.SetSockOpt(&duplicateAddOpt)); diff != "" {
+		t.Errorf("unexpected error from ep.SetSockOpt(&%#v), (-want, +got):\n%s", duplicateAddOpt, diff)
+	}
+	checkInGroups(t, false)
+
+	addOpt := tcpip.AddMembershipsOption(mems)
+	if err := ep.SetSockOpt(&addOpt); err != nil {
+		t.Fatalf("ep.SetSockOpt(&%#v): %s", addOpt, err)
+	}
+	checkInGroups(t, true)
+
+	// Joining groups the endpoint is already a member of fails.
+	if diff := cmp.Diff(&tcpip.ErrPortInUse{}, ep.SetSockOpt(&addOpt)); diff != "" {
+		t.Errorf("unexpected error from ep.SetSockOpt(&%#v), (-want, +got):\n%s", addOpt, diff)
+	}
+
+	removeOpt := tcpip.RemoveMembershipsOption(mems)
+	if err := ep.SetSockOpt(&removeOpt); err != nil {
+		t.Fatalf("ep.SetSockOpt(&%#v): %s", removeOpt, err)
+	}
+	checkInGroups(t, false)
+
+	// Leaving groups the endpoint is not a member of fails.
+	if diff := cmp.Diff(&tcpip.ErrBadLocalAddress{}, ep.SetSockOpt(&removeOpt)); diff != "" {
+		t.Errorf("unexpected error from ep.SetSockOpt(&%#v), (-want, +got):\n%s", removeOpt, diff)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	const nicID = 1
+
+	for _, test := range []struct {
+		name              string
+		flags             tcpip.ShutdownFlags
+		wantWriteErr      tcpip.Error
+		wantShutdownFlags tcpip.ShutdownFlags
+	}{
+		{
+			name:              "read",
+			flags:             tcpip.ShutdownRead,
+			wantShutdownFlags: tcpip.ShutdownRead,
+		},
+		{
+			name:              "write",
+			flags:             tcpip.ShutdownWrite,
+			wantWriteErr:      &tcpip.ErrClosedForSend{},
+			wantShutdownFlags: tcpip.ShutdownWrite,
+		},
+		{
+			name:              "read and write",
+			flags:             tcpip.ShutdownRead | tcpip.ShutdownWrite,
+			wantWriteErr:      &tcpip.ErrClosedForSend{},
+			wantShutdownFlags: tcpip.ShutdownRead | tcpip.ShutdownWrite,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr)
+			s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID}})
+
+			ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+			if diff := cmp.Diff(&tcpip.ErrNotConnected{}, ep.Shutdown(test.flags)); diff != "" {
+				t.Errorf("unexpected error from ep.Shutdown(%d) in the initial state, (-want, +got):\n%s", test.flags, diff)
+			}
+			if got := ep.ShutdownFlags(); got != 0 {
+				t.Errorf("got ep.ShutdownFlags() = %d, want = 0", got)
+			}
+
+			connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+			if err := ep.Connect(connectAddr); err != nil {
+				t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+			}
+			if err := ep.Shutdown(test.flags); err != nil {
+				t.Fatalf("ep.Shutdown(%d): %s", test.flags, err)
+			}
+			if got := ep.ShutdownFlags(); got != test.wantShutdownFlags {
+				t.Errorf("got ep.ShutdownFlags() = %d, want = %d", got, test.wantShutdownFlags)
+			}
+
+			ctx, err := ep.AcquireContextForWrite(tcpip.WriteOptions{})
+			if diff := cmp.Diff(test.wantWriteErr, err); diff != "" {
+				t.Errorf("unexpected error from ep.AcquireContextForWrite({}), (-want, +got):\n%s", diff)
+			}
+			if err == nil {
+				ctx.Release()
+			}
+
+			ep.Close()
+			if diff := cmp.Diff(&tcpip.ErrNotConnected{}, ep.Shutdown(test.flags)); diff != "" {
+				t.Errorf("unexpected error from ep.Shutdown(%d) in the closed state, (-want, +got):\n%s", test.flags, diff)
+			}
+		})
+	}
+}
+
+func TestMulticastLoopStrict(t *testing.T) {
+	const (
+		channelNICID  = 1
+		loopbackNICID = 2
+	)
+
+	loopbackAddr := testutil.MustParse4("127.0.0.1")
+
+	for _, test := range []struct {
+		name          string
+		nicID         tcpip.NICID
+		strict        bool
+		multicastLoop bool
+		dst           tcpip.Address
+		wantErr       tcpip.Error
+	}{
+		{
+			name:    "loopback interface",
+			nicID:   loopbackNICID,
+			strict:  true,
+			dst:     header.IPv4AllSystems,
+			wantErr: &tcpip.ErrNotSupported{},
+		},
+		{
+			name:          "loopback interface with multicast loop",
+			nicID:         loopbackNICID,
+			strict:        true,
+			multicastLoop: true,
+			dst:           header.IPv4AllSystems,
+		},
+		{
+			name:  "loopback interface not strict",
+			nicID: loopbackNICID,
+			dst:   header.IPv4AllSystems,
+		},
+		{
+			name:   "loopback interface unicast",
+			nicID:  loopbackNICID,
+			strict: true,
+			dst:    loopbackAddr,
+		},
+		{
+			name:   "channel interface",
+			nicID:  channelNICID,
+			strict: true,
+			dst:    header.IPv4AllSystems,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			addChannelNIC(t, s, channelNICID, ipv4NICAddr)
+			if err := s.CreateNIC(loopbackNICID, loopback.New()); err != nil {
+				t.Fatalf("s.CreateNIC(%d, _): %s", loopbackNICID, err)
+			}
+			protocolAddr := tcpip.ProtocolAddress{
+				Protocol:          ipv4.ProtocolNumber,
+				AddressWithPrefix: loopbackAddr.WithPrefix(),
+			}
+			if err := s.AddProtocolAddress(loopbackNICID, protocolAddr, stack.AddressProperties{}); err != nil {
+				t.Fatalf("s.AddProtocolAddress(%d, %+v, {}): %s", loopbackNICID, protocolAddr, err)
+			}
+
+			ep, ops := newEndpoint(t, s, ipv4.ProtocolNumber)
+			ops.SetMulticastLoop(test.multicastLoop)
+
+			strict := 0
+			if test.strict {
+				strict = 1
+			}
+			if err := ep.SetSockOptInt(tcpip.MulticastLoopStrictOption, strict); err != nil {
+				t.Fatalf("ep.SetSockOptInt(tcpip.MulticastLoopStrictOption, %d): %s", strict, err)
+			}
+			if v, err := ep.GetSockOptInt(tcpip.MulticastLoopStrictOption); err != nil {
+				t.Fatalf("ep.GetSockOptInt(tcpip.MulticastLoopStrictOption): %s", err)
+			} else if v != strict {
+				t.Errorf("got ep.GetSockOptInt(tcpip.MulticastLoopStrictOption) = %d, want = %d", v, strict)
+			}
+
+			writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{NIC: test.nicID, Addr: test.dst}}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Fatalf("unexpected error from ep.AcquireContextForWrite(%#v), (-want, +got):\n%s", writeOpts, diff)
+			}
+			if err == nil {
+				ctx.Release()
+			}
+		})
+	}
+}
+
+func TestTOSRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		netProto tcpip.NetworkProtocolNumber
+		opt      tcpip.SockOptInt
+		value    int
+		want     int
+		wantErr  tcpip.Error
+	}{
+		{
+			name:     "IPv4 zero",
+			netProto: ipv4.ProtocolNumber,
+			opt:      tcpip.IPv4TOSOption,
+			value:    0,
+			want:     0,
+		},
+		{
+			name:     "IPv4 DSCP",
+			netProto: ipv4.ProtocolNumber,
+			opt:      tcpip.IPv4TOSOption,
+			value:    0xb8,
+			want:     0xb8,
+		},
+		{
+			name:     "IPv4 ECN",
+			netProto: ipv4.ProtocolNumber,
+			opt:      tcpip.IPv4TOSOption,
+			value:    0x03,
+			want:     0x03,
+		},
+		{
+			name:     "IPv4 DSCP and ECN",
+			netProto: ipv4.ProtocolNumber,
+			opt:      tcpip.IPv4TOSOption,
+			value:    0xb9,
+			want:     0xb9,
+		},
+		{
+			name:     "IPv4 truncated",
+			netProto: ipv4.ProtocolNumber,
+			opt:      tcpip.IPv4TOSOption,
+			value:    0x1b9,
+			want:     0xb9,
+		},
+		{
+			name:     "IPv6 DSCP and ECN",
+			netProto: ipv6.ProtocolNumber,
+			opt:      tcpip.IPv6TrafficClassOption,
+			value:    0xb9,
+			want:     0xb9,
+		},
+		{
+			name:     "IPv6 ECN",
+			netProto: ipv6.ProtocolNumber,
+			opt:      tcpip.IPv6TrafficClassOption,
+			value:    0x02,
+			want:     0x02,
+		},
+		{
+			name:     "IPv6 too large",
+			netProto: ipv6.ProtocolNumber,
+			opt:      tcpip.IPv6TrafficClassOption,
+			value:    0x100,
+			wantErr:  &tcpip.ErrInvalidOptionValue{},
+		},
+		{
+			name:     "IPv6 negative",
+			netProto: ipv6.ProtocolNumber,
+			opt:      tcpip.IPv6TrafficClassOption,
+			value:    -1,
+			wantErr:  &tcpip.ErrInvalidOptionValue{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+
+			ep, _ := newEndpoint(t, s, test.netProto)
+
+			err := ep.SetSockOptInt(test.opt, test.value)
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Fatalf("unexpected error from ep.SetSockOptInt(%d, %d), (-want, +got):\n%s", test.opt, test.value, diff)
+			}
+			v, err := ep.GetSockOptInt(test.opt)
+			if err != nil {
+				t.Fatalf("ep.GetSockOptInt(%d): %s", test.opt, err)
+			}
+			if v != test.want {
+				t.Errorf("got ep.GetSockOptInt(%d) = %#x, want = %#x", test.opt, v, test.want)
+			}
+		})
+	}
+}
+
+func TestBindUnspecified(t *testing.T) {
+	const nicID = 1
+
+	v4MappedRemoteAddr := testutil.MustParse6("::ffff:0607:0809")
+
+	for _, test := range []struct {
+		name     string
+		netProto tcpip.NetworkProtocolNumber
+		bindAddr tcpip.Address
+		v6Only   bool
+		dsts     map[tcpip.Address]tcpip.Error
+	}{
+		{
+			name:     "IPv4",
+			netProto: ipv4.ProtocolNumber,
+			bindAddr: header.IPv4Any,
+			dsts: map[tcpip.Address]tcpip.Error{
+				ipv4RemoteAddr: nil,
+				ipv6RemoteAddr: &tcpip.ErrAddressFamilyNotSupported{},
+			},
+		},
+		{
+			name:     "IPv6 dual-stack",
+			netProto: ipv6.ProtocolNumber,
+			bindAddr: header.IPv6Any,
+			dsts: map[tcpip.Address]tcpip.Error{
+				ipv6RemoteAddr:     nil,
+				v4MappedRemoteAddr: nil,
+			},
+		},
+		{
+			name:     "IPv6 V6Only",
+			netProto: ipv6.ProtocolNumber,
+			bindAddr: header.IPv6Any,
+			v6Only:   true,
+			dsts: map[tcpip.Address]tcpip.Error{
+				ipv6RemoteAddr:     nil,
+				v4MappedRemoteAddr: &tcpip.ErrNetworkUnreachable{},
+			},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr, ipv6NICAddr)
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+				{Destination: ipv6RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+			})
+
+			ep, ops := newEndpoint(t, s, test.netProto)
+			if err := ops.SetV6Only(test.v6Only); err != nil {
+				t.Fatalf("ops.SetV6Only(%t): %s", test.v6Only, err)
+			}
+
+			bindAddr := tcpip.FullAddress{Addr: test.bindAddr}
+			if err := ep.Bind(bindAddr); err != nil {
+				t.Fatalf("ep.Bind(%#v): %s", bindAddr, err)
+			}
+			if diff := cmp.Diff(tcpip.FullAddress{}, ep.GetLocalAddress()); diff != "" {
+				t.Errorf("ep.GetLocalAddress() mismatch (-want +got):\n%s", diff)
+			}
+
+			for dst, wantErr := range test.dsts {
+				writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: dst}}
+				ctx, err := ep.AcquireContextForWrite(writeOpts)
+				if diff := cmp.Diff(wantErr, err); diff != "" {
+					t.Errorf("unexpected error from ep.AcquireContextForWrite(%#v), (-want, +got):\n%s", writeOpts, diff)
+				}
+				if err == nil {
+					ctx.Release()
+				}
+			}
+		})
+	}
+}
+
+func TestCloseWriteRace(t *testing.T) {
+	const (
+		nicID      = 1
+		iterations = 100
+		writers    = 4
+	)
+
+	for _, test := range []struct {
+		name           string
+		connect        bool
+		routeCacheSize int
+	}{
+		{name: "Connected", connect: true},
+		{name: "Unconnected"},
+		{name: "Unconnected with route cache", routeCacheSize: 4},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			if err := s.CreateNIC(nicID, loopback.New()); err != nil {
+				t.Fatalf("s.CreateNIC(%d, _): %s", nicID, err)
+			}
+			protocolAddr := tcpip.ProtocolAddress{
+				Protocol:          ipv4.ProtocolNumber,
+				AddressWithPrefix: ipv4NICAddr.WithPrefix(),
+			}
+			if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+				t.Fatalf("s.AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+			}
+			s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID}})
+
+			for i := 0; i < iterations; i++ {
+				ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+				if err := ep.SetSockOptInt(tcpip.RouteCacheSizeOption, test.routeCacheSize); err != nil {
+					t.Fatalf("ep.SetSockOptInt(tcpip.RouteCacheSizeOption, %d): %s", test.routeCacheSize, err)
+				}
+				writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: ipv4RemoteAddr}}
+				if test.connect {
+					if err := ep.Connect(*writeOpts.To); err != nil {
+						t.Fatalf("ep.Connect(%#v): %s", *writeOpts.To, err)
+					}
+					writeOpts = tcpip.WriteOptions{}
+				}
+
+				var wg sync.WaitGroup
+				wg.Add(writers + 1)
+				for j := 0; j < writers; j++ {
+					go func() {
+						defer wg.Done()
+						for {
+							ctx, err := ep.AcquireContextForWrite(writeOpts)
+							if err != nil {
+								if _, ok := err.(*tcpip.ErrInvalidEndpointState); !ok {
+									t.Errorf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+								}
+								return
+							}
+							pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+								ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+							})
+							if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+								t.Errorf("ctx.WritePacket(_, false): %s", err)
+							}
+							pkt.DecRef()
+							ctx.Release()
+						}
+					}()
+				}
+				go func() {
+					defer wg.Done()
+					ep.Close()
+				}()
+				wg.Wait()
+			}
+		})
+	}
+}
+
+func TestMulticastInterfaceReset(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	nic2Addr := testutil.MustParse4("2.3.4.5")
+	multicastAddr := testutil.MustParse4("224.0.0.1")
+
+	for _, test := range []struct {
+		name      string
+		bindNICID tcpip.NICID
+		resetAddr tcpip.Address
+		wantNICID tcpip.NICID
+	}{
+		{
+			name:      "empty address",
+			wantNICID: nicID1,
+		},
+		{
+			name:      "IPv4 any address",
+			resetAddr: header.IPv4Any,
+			wantNICID: nicID1,
+		},
+		{
+			name:      "bound to NIC",
+			bindNICID: nicID2,
+			resetAddr: header.IPv4Any,
+			wantNICID: nicID2,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			links := map[tcpip.NICID]*channel.Endpoint{
+				nicID1: addChannelNIC(t, s, nicID1, ipv4NICAddr),
+				nicID2: addChannelNIC(t, s, nicID2, nic2Addr),
+			}
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: header.IPv4EmptySubnet, NIC: nicID1},
+				{Destination: header.IPv4EmptySubnet, NIC: nicID2},
+			})
+
+			ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+			if test.bindNICID != 0 {
+				bindAddr := tcpip.FullAddress{NIC: test.bindNICID}
+				if err := ep.Bind(bindAddr); err != nil {
+					t.Fatalf("ep.Bind(%#v): %s", bindAddr, err)
+				}
+			}
+
+			setOpt := tcpip.MulticastInterfaceOption{NIC: nicID2}
+			if err := ep.SetSockOpt(&setOpt); err != nil {
+				t.Fatalf("ep.SetSockOpt(&%#v): %s", setOpt, err)
+			}
+			resetOpt := tcpip.MulticastInterfaceOption{InterfaceAddr: test.resetAddr}
+			if err := ep.SetSockOpt(&resetOpt); err != nil {
+				t.Fatalf("ep.SetSockOpt(&%#v): %s", resetOpt, err)
+			}
+			var getOpt tcpip.MulticastInterfaceOption
+			if err := ep.GetSockOpt(&getOpt); err != nil {
+				t.Fatalf("ep.GetSockOpt(_): %s", err)
+			}
+			if diff := cmp.Diff(tcpip.MulticastInterfaceOption{}, getOpt); diff != "" {
+				t.Errorf("multicast interface option mismatch (-want +got):\n%s", diff)
+			}
+
+			writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: multicastAddr}}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if err != nil {
+				t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+			}
+			defer ctx.Release()
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+			})
+			defer pkt.DecRef()
+			if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+				t.Fatalf("ctx.WritePacket(_, false): %s", err)
+			}
+			for nicID, e := range links {
+				pkt := e.Read()
+				if got, want := !pkt.IsNil(), nicID == test.wantNICID; got != want {
+					t.Errorf("got packet read from NIC %d = %t, want = %t", nicID, got, want)
+				}
+				if !pkt.IsNil() {
+					pkt.DecRef()
+				}
+			}
+		})
+	}
+}
+
+// endpointOptionsHandler forwards socket option changes to a network endpoint
+// as the transport endpoints do.
+type endpointOptionsHandler struct {
+	tcpip.DefaultSocketOptionsHandler
+
+	s  *stack.Stack
+	ep *network.Endpoint
+}
+
+func (h *endpointOptionsHandler) HasNIC(id int32) bool {
+	return h.s.HasNIC(tcpip.NICID(id))
+}
+
+func (h *endpointOptionsHandler) OnSetBindToDevice(id int32) tcpip.Error {
+	return h.ep.OnSetBindToDevice(tcpip.NICID(id))
+}
+
+func (h *endpointOptionsHandler) OnSetV6Only(bool) tcpip.Error {
+	return h.ep.OnSetV6Only()
+}
+
+func TestV6OnlyAfterBind(t *testing.T) {
+	const nicID = 1
+
+	for _, test := range []struct {
+		name    string
+		bind    bool
+		connect bool
+		wantErr tcpip.Error
+	}{
+		{
+			name: "initial",
+		},
+		{
+			name:    "bound",
+			bind:    true,
+			wantErr: &tcpip.ErrInvalidEndpointState{},
+		},
+		{
+			name:    "connected",
+			connect: true,
+			wantErr: &tcpip.ErrInvalidEndpointState{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol, ipv6.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr, ipv6NICAddr)
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: ipv6RemoteAddr.WithPrefix().Subnet(), NIC: nicID},
+			})
+
+			ep, ops := newEndpoint(t, s, ipv6.ProtocolNumber)
+
+			if test.bind {
+				if err := ep.Bind(tcpip.FullAddress{}); err != nil {
+					t.Fatalf("ep.Bind({}): %s", err)
+				}
+			}
+			if test.connect {
+				addr := tcpip.FullAddress{Addr: ipv6RemoteAddr, Port: 80}
+				if err := ep.Connect(addr); err != nil {
+					t.Fatalf("ep.Connect(%#v): %s", addr, err)
+				}
+			}
+
+			if diff := cmp.Diff(test.wantErr, ops.SetV6Only(true)); diff != "" {
+				t.Errorf("ops.SetV6Only(true) error mismatch (-want +got):\n%s", diff)
+			}
+			if got, want := ops.GetV6Only(), test.wantErr == nil; got != want {
+				t.Errorf("got ops.GetV6Only() = %t, want = %t", got, want)
+			}
+		})
+	}
+}
+
+func TestWriteNICSelection(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	nic2Addr := testutil.MustParse4("2.3.4.5")
+	multicastAddr := testutil.MustParse4("224.0.1.1")
+
+	for _, test := range []struct {
+		name         string
+		dst          tcpip.Address
+		toNIC        tcpip.NICID
+		device       tcpip.NICID
+		bindNIC      tcpip.NICID
+		multicastNIC tcpip.NICID
+		wantNIC      tcpip.NICID
+		wantErr      tcpip.Error
+	}{
+		{
+			name:    "unicast unconstrained",
+			dst:     ipv4RemoteAddr,
+			wantNIC: nicID1,
+		},
+		{
+			name:    "unicast destination NIC",
+			dst:     ipv4RemoteAddr,
+			toNIC:   nicID2,
+			wantNIC: nicID2,
+		},
+		{
+			name:    "unicast device",
+			dst:     ipv4RemoteAddr,
+			device:  nicID2,
+			wantNIC: nicID2,
+		},
+		{
+			name:    "unicast bound NIC",
+			dst:     ipv4RemoteAddr,
+			bindNIC: nicID2,
+			wantNIC: nicID2,
+		},
+		{
+			name:    "unicast destination NIC over device",
+			dst:     ipv4RemoteAddr,
+			toNIC:   nicID2,
+			device:  nicID1,
+			wantNIC: nicID2,
+		},
+		{
+			name:    "unicast destination NIC matches bound NIC",
+			dst:     ipv4RemoteAddr,
+			toNIC:   nicID2,
+			bindNIC: nicID2,
+			wantNIC: nicID2,
+		},
+		{
+			name:    "unicast destination NIC conflicts with bound NIC",
+			dst:     ipv4RemoteAddr,
+			toNIC:   nicID1,
+			bindNIC: nicID2,
+			wantErr: &tcpip.ErrHostUnreachable{},
+		},
+		{
+			name:    "unicast device conflicts with bound NIC",
+			dst:     ipv4RemoteAddr,
+			device:  nicID1,
+			bindNIC: nicID2,
+			wantErr: &tcpip.ErrHostUnreachable{},
+		},
+		{
+			name:         "unicast ignores multicast interface",
+			dst:          ipv4RemoteAddr,
+			multicastNIC: nicID2,
+			wantNIC:      nicID1,
+		},
+		{
+			name:         "multicast interface",
+			dst:          multicastAddr,
+			multicastNIC: nicID2,
+			wantNIC:      nicID2,
+		},
+		{
+			name:         "multicast device matches multicast interface",
+			dst:          multicastAddr,
+			device:       nicID2,
+			multicastNIC: nicID2,
+			wantNIC:      nicID2,
+		},
+		{
+			name:         "multicast device conflicts with multicast interface",
+			dst:          multicastAddr,
+			device:       nicID1,
+			multicastNIC: nicID2,
+			wantErr:      &tcpip.ErrHostUnreachable{},
+		},
+		{
+			name:         "multicast destination NIC over multicast interface",
+			dst:          multicastAddr,
+			toNIC:        nicID1,
+			multicastNIC: nicID2,
+			wantNIC:      nicID1,
+		},
+		{
+			name:         "multicast destination NIC over conflicting device",
+			dst:          multicastAddr,
+			toNIC:        nicID2,
+			device:       nicID1,
+			multicastNIC: nicID2,
+			wantNIC:      nicID2,
+		},
+		{
+			name:         "multicast bound NIC over multicast interface",
+			dst:          multicastAddr,
+			bindNIC:      nicID1,
+			multicastNIC: nicID2,
+			wantNIC:      nicID1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			links := map[tcpip.NICID]*channel.Endpoint{
+				nicID1: addChannelNIC(t, s, nicID1, ipv4NICAddr),
+				nicID2: addChannelNIC(t, s, nicID2, nic2Addr),
+			}
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: header.IPv4EmptySubnet, NIC: nicID1},
+				{Destination: header.IPv4EmptySubnet, NIC: nicID2},
+			})
+
+			ep, ops := newEndpoint(t, s, ipv4.ProtocolNumber)
+			ops.SetMulticastLoop(false)
+
+			if test.multicastNIC != 0 {
+				ifOpt := tcpip.MulticastInterfaceOption{NIC: test.multicastNIC}
+				if err := ep.SetSockOpt(&ifOpt); err != nil {
+					t.Fatalf("ep.SetSockOpt(&%#v): %s", ifOpt, err)
+				}
+			}
+			if test.device != 0 {
+				if err := ops.SetBindToDevice(int32(test.device)); err != nil {
+					t.Fatalf("ops.SetBindToDevice(%d): %s", test.device, err)
+				}
+			}
+			if test.bindNIC != 0 {
+				bindAddr := tcpip.FullAddress{NIC: test.bindNIC}
+				if err := ep.Bind(bindAddr); err != nil {
+					t.Fatalf("ep.Bind(%#v): %s", bindAddr, err)
+				}
+			}
+
+			writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{NIC: test.toNIC, Addr: test.dst}}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if diff := cmp.Diff(test.wantErr, err); diff != "" {
+				t.Fatalf("ep.AcquireContextForWrite(%#v) error mismatch (-want +got):\n%s", writeOpts, diff)
+			}
+			if err != nil {
+				return
+			}
+			defer ctx.Release()
+			pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+				ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+			})
+			defer pkt.DecRef()
+			if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+				t.Fatalf("ctx.WritePacket(_, false): %s", err)
+			}
+			for nicID, e := range links {
+				pkt := e.Read()
+				if got, want := !pkt.IsNil(), nicID == test.wantNIC; got != want {
+					t.Errorf("got packet read from NIC %d = %t, want = %t", nicID, got, want)
+				}
+				if !pkt.IsNil() {
+					pkt.DecRef()
+				}
+			}
+		})
+	}
+}
+
+func TestBindToDeviceAfterBind(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+		nicID3 = 3
+	)
+
+	nic2Addr := testutil.MustParse4("2.3.4.5")
+	nic3Addr := testutil.MustParse4("3.4.5.6")
+
+	s := newStack(t, ipv4.NewProtocol)
+	links := map[tcpip.NICID]*channel.Endpoint{
+		nicID1: addChannelNIC(t, s, nicID1, ipv4NICAddr),
+		nicID2: addChannelNIC(t, s, nicID2, nic2Addr),
+		nicID3: addChannelNIC(t, s, nicID3, nic3Addr),
+	}
+	s.SetRouteTable([]tcpip.Route{
+		{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID1},
+		{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID2},
+	})
+
+	ep, ops := newEndpoint(t, s, ipv4.ProtocolNumber)
+	if err := ep.Bind(tcpip.FullAddress{}); err != nil {
+		t.Fatalf("ep.Bind({}): %s", err)
+	}
+
+	checkSend := func(t *testing.T, wantNICID tcpip.NICID, wantSrc tcpip.Address) {
+		t.Helper()
+
+		writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: ipv4RemoteAddr}}
+		ctx, err := ep.AcquireContextForWrite(writeOpts)
+		if err != nil {
+			t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+		}
+		defer ctx.Release()
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+		})
+		defer pkt.DecRef()
+		if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+			t.Fatalf("ctx.WritePacket(_, false): %s", err)
+		}
+		for nicID, e := range links {
+			pkt := e.Read()
+			if got, want := !pkt.IsNil(), nicID == wantNICID; got != want {
+				t.Fatalf("got packet read from NIC %d = %t, want = %t", nicID, got, want)
+			}
+			if pkt.IsNil() {
+				continue
+			}
+			payload := stack.PayloadSince(pkt.NetworkHeader())
+			checker.IPv4(t, payload, checker.SrcAddr(wantSrc), checker.DstAddr(ipv4RemoteAddr))
+			payload.Release()
+			pkt.DecRef()
+		}
+	}
+
+	checkSend(t, nicID1, ipv4NICAddr)
+
+	if err := ops.SetBindToDevice(nicID2); err != nil {
+		t.Fatalf("ops.SetBindToDevice(%d): %s", nicID2, err)
+	}
+	checkSend(t, nicID2, nic2Addr)
+	if diff := cmp.Diff(tcpip.FullAddress{}, ep.GetLocalAddress()); diff != "" {
+		t.Errorf("ep.GetLocalAddress() mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := ops.SetBindToDevice(0); err != nil {
+		t.Fatalf("ops.SetBindToDevice(0): %s", err)
+	}
+	checkSend(t, nicID1, ipv4NICAddr)
+
+	// Changing the device of a connected endpoint resolves the connected route
+	// through the new device.
+	connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+	if err := ep.Connect(connectAddr); err != nil {
+		t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+	}
+	checkConnectedSrc := func(t *testing.T, want tcpip.Address) {
+		t.Helper()
+
+		ctx, err := ep.AcquireContextForWrite(tcpip.WriteOptions{})
+		if err != nil {
+			t.Fatalf("ep.AcquireContextForWrite({}): %s", err)
+		}
+		defer ctx.Release()
+		if got := ctx.PacketInfo().LocalAddress; got != want {
+			t.Errorf("got ctx.PacketInfo().LocalAddress = %s, want = %s", got, want)
+		}
+	}
+	checkConnectedSrc(t, ipv4NICAddr)
+	if err := ops.SetBindToDevice(nicID2); err != nil {
+		t.Fatalf("ops.SetBindToDevice(%d): %s", nicID2, err)
+	}
+	if got := ops.GetBindToDevice(); got != nicID2 {
+		t.Errorf("got ops.GetBindToDevice() = %d, want = %d", got, nicID2)
+	}
+	if got := ep.Info().BindNICID; got != nicID2 {
+		t.Errorf("got ep.Info().BindNICID = %d, want = %d", got, nicID2)
+	}
+	checkConnectedSrc(t, nic2Addr)
+
+	// The device may not be changed to one the peer is not reachable through.
+	if diff := cmp.Diff(&tcpip.ErrHostUnreachable{}, ops.SetBindToDevice(nicID3)); diff != "" {
+		t.Errorf("ops.SetBindToDevice(%d) mismatch (-want +got):\n%s", nicID3, diff)
+	}
+	if got := ops.GetBindToDevice(); got != nicID2 {
+		t.Errorf("got ops.GetBindToDevice() = %d, want = %d", got, nicID2)
+	}
+	checkConnectedSrc(t, nic2Addr)
+}
+
+func TestMulticastInterfaceWithBindToDevice(t *testing.T) {
+	const (
+		nicID1 = 1
+		nicID2 = 2
+	)
+
+	nic2Addr := testutil.MustParse4("2.3.4.5")
+	multicastAddr := testutil.MustParse4("224.0.0.1")
+
+	for _, test := range []struct {
+		name             string
+		device           tcpip.NICID
+		multicastNICID   tcpip.NICID
+		wantNICID        tcpip.NICID
+		wantErr          tcpip.Error
+		unicastWantNICID tcpip.NICID
+	}{
+		{
+			name:             "device only",
+			device:           nicID2,
+			wantNICID:        nicID2,
+			unicastWantNICID: nicID2,
+		},
+		{
+			name:             "multicast interface only",
+			multicastNICID:   nicID2,
+			wantNICID:        nicID2,
+			unicastWantNICID: nicID1,
+		},
+		{
+			name:             "same interface",
+			device:           nicID2,
+			multicastNICID:   nicID2,
+			wantNICID:        nicID2,
+			unicastWantNICID: nicID2,
+		},
+		{
+			name:             "conflicting interfaces",
+			device:           nicID1,
+			multicastNICID:   nicID2,
+			wantErr:          &tcpip.ErrHostUnreachable{},
+			unicastWantNICID: nicID1,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			links := map[tcpip.NICID]*channel.Endpoint{
+				nicID1: addChannelNIC(t, s, nicID1, ipv4NICAddr),
+				nicID2: addChannelNIC(t, s, nicID2, nic2Addr),
+			}
+			s.SetRouteTable([]tcpip.Route{
+				{Destination: header.IPv4EmptySubnet, NIC: nicID1},
+				{Destination: header.IPv4EmptySubnet, NIC: nicID2},
+			})
+
+			ep, ops := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+			if test.multicastNICID != 0 {
+				opt := tcpip.MulticastInterfaceOption{NIC: test.multicastNICID}
+				if err := ep.SetSockOpt(&opt); err != nil {
+					t.Fatalf("ep.SetSockOpt(&%#v): %s", opt, err)
+				}
+			}
+			if err := ops.SetBindToDevice(int32(test.device)); err != nil {
+				t.Fatalf("ops.SetBindToDevice(%d): %s", test.device, err)
+			}
+
+			write := func(t *testing.T, dst tcpip.Address, wantNICID tcpip.NICID, wantErr tcpip.Error) {
+				t.Helper()
+
+				writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: dst}}
+				ctx, err := ep.AcquireContextForWrite(writeOpts)
+				if diff := cmp.Diff(wantErr, err); diff != "" {
+					t.Fatalf("unexpected error from ep.AcquireContextForWrite(%#v), (-want, +got):\n%s", writeOpts, diff)
+				}
+				if err != nil {
+					return
+				}
+				defer ctx.Release()
+				pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+					ReserveHeaderBytes: int(ctx.PacketInfo().MaxHeaderLength),
+				})
+				defer pkt.DecRef()
+				if err := ctx.WritePacket(pkt, false /* headerIncluded */); err != nil {
+					t.Fatalf("ctx.WritePacket(_, false): %s", err)
+				}
+				for nicID, e := range links {
+					pkt := e.Read()
+					if got, want := !pkt.IsNil(), nicID == wantNICID; got != want {
+						t.Errorf("got packet read from NIC %d = %t, want = %t", nicID, got, want)
+					}
+					if !pkt.IsNil() {
+						pkt.DecRef()
+					}
+				}
+			}
+
+			write(t, multicastAddr, test.wantNICID, test.wantErr)
+			// Unicast writes only honor the device.
+			write(t, ipv4RemoteAddr, test.unicastWantNICID, nil)
+		})
+	}
+}
+
+func TestConnectedInfo(t *testing.T) {
+	const nicID = 1
+
+	for _, test := range []struct {
+		name              string
+		bindAddr          *tcpip.FullAddress
+		disconnect        bool
+		wantInfoLocalAddr tcpip.Address
+		wantLocalAddr     tcpip.Address
+		wantRemoteAddr    tcpip.Address
+	}{
+		{
+			name:              "connected",
+			wantInfoLocalAddr: ipv4NICAddr,
+			wantLocalAddr:     ipv4NICAddr,
+			wantRemoteAddr:    ipv4RemoteAddr,
+		},
+		{
+			name:           "bound to unspecified address then connected",
+			bindAddr:       &tcpip.FullAddress{},
+			wantLocalAddr:  ipv4NICAddr,
+			wantRemoteAddr: ipv4RemoteAddr,
+		},
+		{
+			name:              "bound to address then connected",
+			bindAddr:          &tcpip.FullAddress{Addr: ipv4NICAddr},
+			wantInfoLocalAddr: ipv4NICAddr,
+			wantLocalAddr:     ipv4NICAddr,
+			wantRemoteAddr:    ipv4RemoteAddr,
+		},
+		{
+			name:              "bound to address then disconnected",
+			bindAddr:          &tcpip.FullAddress{Addr: ipv4NICAddr},
+			disconnect:        true,
+			wantInfoLocalAddr: ipv4NICAddr,
+			wantLocalAddr:     ipv4NICAddr,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr)
+			s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID}})
+
+			ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+			if test.bindAddr != nil {
+				if err := ep.Bind(*test.bindAddr); err != nil {
+					t.Fatalf("ep.Bind(%#v): %s", *test.bindAddr, err)
+				}
+			}
+			connectAddr := tcpip.FullAddress{Addr: ipv4RemoteAddr}
+			if err := ep.Connect(connectAddr); err != nil {
+				t.Fatalf("ep.Connect(%#v): %s", connectAddr, err)
+			}
+			if test.disconnect {
+				ep.Disconnect()
+			}
+
+			if got := ep.Info().ID.LocalAddress; got != test.wantInfoLocalAddr {
+				t.Errorf("got ep.Info().ID.LocalAddress = %s, want = %s", got, test.wantInfoLocalAddr)
+			}
+
+			id := ep.ConnectedInfo().ID
+			if got := ep.GetLocalAddress().Addr; got != id.LocalAddress {
+				t.Errorf("got ep.GetLocalAddress().Addr = %s, want = %s", got, id.LocalAddress)
+			}
+			if id.LocalAddress != test.wantLocalAddr {
+				t.Errorf("got ep.ConnectedInfo().ID.LocalAddress = %s, want = %s", id.LocalAddress, test.wantLocalAddr)
+			}
+			remoteAddr, _ := ep.GetRemoteAddress()
+			if remoteAddr.Addr != id.RemoteAddress {
+				t.Errorf("got ep.GetRemoteAddress() = %s, want = %s", remoteAddr.Addr, id.RemoteAddress)
+			}
+			if id.RemoteAddress != test.wantRemoteAddr {
+				t.Errorf("got ep.ConnectedInfo().ID.RemoteAddress = %s, want = %s", id.RemoteAddress, test.wantRemoteAddr)
+			}
+		})
+	}
+}
+
+func TestLastError(t *testing.T) {
+	s := newStack(t, ipv4.NewProtocol)
+
+	ep, ops := newEndpoint(t, s, ipv4.ProtocolNumber)
+
+	checkLastError := func(t *testing.T, want tcpip.Error) {
+		t.Helper()
+
+		if got, want := ep.HasLastError(), want != nil; got != want {
+			t.Errorf("got ep.HasLastError() = %t, want = %t", got, want)
+		}
+		if diff := cmp.Diff(want, ep.LastError()); diff != "" {
+			t.Errorf("ep.LastError() mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	checkLastError(t, nil)
+
+	// The error is cleared when it is read.
+	ep.UpdateLastError(&tcpip.ErrConnectionRefused{})
+	checkLastError(t, &tcpip.ErrConnectionRefused{})
+	checkLastError(t, nil)
+
+	// Only the last error is kept.
+	ep.UpdateLastError(&tcpip.ErrConnectionRefused{})
+	ep.UpdateLastError(&tcpip.ErrHostUnreachable{})
+	checkLastError(t, &tcpip.ErrHostUnreachable{})
+	checkLastError(t, nil)
+
+	// Resetting the endpoint drops an unread error.
+	ep.UpdateLastError(&tcpip.ErrConnectionRefused{})
+	ep.Close()
+	ep.Reset()
+	ep.Init(s, ipv4.ProtocolNumber, udp.ProtocolNumber, ops, &waiter.Queue{})
+	checkLastError(t, nil)
+}
+
+func TestWriteDiagnostics(t *testing.T) {
+	const nicID = 1
+
+	unroutableAddr := testutil.MustParse4("10.0.0.1")
+
+	for _, test := range []struct {
+		name        string
+		disabled    bool
+		setup       func(*testing.T, *network.Endpoint)
+		dst         tcpip.Address
+		wantNoError bool
+		want        network.WriteError
+	}{
+		{
+			name:     "disabled",
+			disabled: true,
+			dst:      unroutableAddr,
+		},
+		{
+			name: "closed",
+			setup: func(_ *testing.T, ep *network.Endpoint) {
+				ep.Close()
+			},
+			dst: ipv4RemoteAddr,
+			want: network.WriteError{
+				Reason:        network.WriteDropClosed,
+				RemoteAddress: ipv4RemoteAddr,
+			},
+		},
+		{
+			name: "shutdown",
+			setup: func(t *testing.T, ep *network.Endpoint) {
+				if err := ep.Shutdown(tcpip.ShutdownWrite); err != nil {
+					t.Fatalf("ep.Shutdown(tcpip.ShutdownWrite): %s", err)
+				}
+			},
+			dst: ipv4RemoteAddr,
+			want: network.WriteError{
+				Reason:        network.WriteDropShutdown,
+				RemoteAddress: ipv4RemoteAddr,
+			},
+		},
+		{
+			name: "destination required",
+			want: network.WriteError{
+				Reason: network.WriteDropDestinationRequired,
+			},
+		},
+		{
+			name: "address family",
+			dst:  ipv6RemoteAddr,
+			want: network.WriteError{
+				Reason:        network.WriteDropAddressFamily,
+				RemoteAddress: ipv6RemoteAddr,
+			},
+		},
+		{
+			name: "broadcast disabled",
+			dst:  header.IPv4Broadcast,
+			want: network.WriteError{
+				Reason:        network.WriteDropBroadcastDisabled,
+				RemoteAddress: header.IPv4Broadcast,
+			},
+		},
+		{
+			name: "no route",
+			setup: func(t *testing.T, ep *network.Endpoint) {
+				bindAddr := tcpip.FullAddress{NIC: nicID}
+				if err := ep.Bind(bindAddr); err != nil {
+					t.Fatalf("ep.Bind(%#v): %s", bindAddr, err)
+				}
+			},
+			dst: unroutableAddr,
+			want: network.WriteError{
+				Reason:        network.WriteDropNoRoute,
+				NIC:           nicID,
+				RemoteAddress: unroutableAddr,
+			},
+		},
+		{
+			name:        "success",
+			dst:         ipv4RemoteAddr,
+			wantNoError: true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr)
+			s.SetRouteTable([]tcpip.Route{{Destination: ipv4RemoteAddr.WithPrefix().Subnet(), NIC: nicID}})
+
+			ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+			if !test.disabled {
+				if err := ep.SetSockOptInt(tcpip.WriteDiagnosticsOption, 1); err != nil {
+					t.Fatalf("ep.SetSockOptInt(tcpip.WriteDiagnosticsOption, 1): %s", err)
+				}
+			}
+			if test.setup != nil {
+				test.setup(t, ep)
+			}
+
+			var writeOpts tcpip.WriteOptions
+			if test.dst.BitLen() != 0 {
+				writeOpts.To = &tcpip.FullAddress{Addr: test.dst}
+			}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if err == nil {
+				ctx.Release()
+			}
+			if got, want := err == nil, test.wantNoError; got != want {
+				t.Fatalf("got ep.AcquireContextForWrite(%#v) = %s, want error = %t", writeOpts, err, !want)
+			}
+
+			want := test.want
+			if want.Reason != network.WriteDropNone {
+				want.Err = err
+			}
+			if diff := cmp.Diff(want, ep.LastWriteError()); diff != "" {
+				t.Errorf("ep.LastWriteError() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWriteDiagnosticsTTLSource(t *testing.T) {
+	const (
+		nicID       = 1
+		explicitTTL = 7
+		endpointTTL = 100
+	)
+
+	multicastAddr := testutil.MustParse4("224.0.1.1")
+
+	for _, test := range []struct {
+		name        string
+		disabled    bool
+		explicitTTL bool
+		endpointTTL bool
+		cmsgTTL     bool
+		dst         tcpip.Address
+		want        network.TTLSource
+	}{
+		{
+			name:        "disabled",
+			disabled:    true,
+			explicitTTL: true,
+			dst:         ipv4RemoteAddr,
+			want:        network.TTLSourceNone,
+		},
+		{
+			name:        "control message",
+			explicitTTL: true,
+			cmsgTTL:     true,
+			dst:         ipv4RemoteAddr,
+			want:        network.TTLSourceControlMessage,
+		},
+		{
+			name:        "explicit",
+			explicitTTL: true,
+			endpointTTL: true,
+			dst:         ipv4RemoteAddr,
+			want:        network.TTLSourceExplicit,
+		},
+		{
+			name:        "multicast",
+			explicitTTL: true,
+			dst:         multicastAddr,
+			want:        network.TTLSourceMulticast,
+		},
+		{
+			name:        "endpoint default",
+			endpointTTL: true,
+			dst:         ipv4RemoteAddr,
+			want:        network.TTLSourceEndpointDefault,
+		},
+		{
+			name: "route default",
+			dst:  ipv4RemoteAddr,
+			want: network.TTLSourceRouteDefault,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s := newStack(t, ipv4.NewProtocol)
+			addChannelNIC(t, s, nicID, ipv4NICAddr)
+			s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID}})
+
+			ep, _ := newEndpoint(t, s, ipv4.ProtocolNumber)
+			if !test.disabled {
+				if err := ep.SetSockOptInt(tcpip.WriteDiagnosticsOption, 1); err != nil {
+					t.Fatalf("ep.SetSockOptInt(tcpip.WriteDiagnosticsOption, 1): %s", err)
+				}
+			}
+			if test.explicitTTL {
+				if err := ep.SetSockOptInt(tcpip.IPv4TTLOption, explicitTTL); err != nil {
+					t.Fatalf("ep.SetSockOptInt(tcpip.IPv4TTLOption, %d): %s", explicitTTL, err)
+				}
+			}
+			if test.endpointTTL {
+				if err := ep.SetSockOptInt(tcpip.EndpointDefaultTTLOption, endpointTTL); err != nil {
+					t.Fatalf("ep.SetSockOptInt(tcpip.EndpointDefaultTTLOption, %d): %s", endpointTTL, err)
+				}
+			}
+
+			if got := ep.LastTTLSource(); got != network.TTLSourceNone {
+				t.Fatalf("got ep.LastTTLSource() = %s before writing, want = %s", got, network.TTLSourceNone)
+			}
+
+			writeOpts := tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: test.dst}}
+			if test.cmsgTTL {
+				writeOpts.ControlMessages = tcpip.SendableControlMessages{HasTTL: true, TTL: 1}
+			}
+			ctx, err := ep.AcquireContextForWrite(writeOpts)
+			if err != nil {
+				t.Fatalf("ep.AcquireContextForWrite(%#v): %s", writeOpts, err)
+			}
+			ctx.Release()
+
+			if got := ep.LastTTLSource(); got != test.want {
+				t.Errorf("got ep.LastTTLSource() = %s, want = %s", got, test.want)
+			}
+
+			// Resetting the endpoint forgets the recorded source.
+			ep.Close()
+			ep.Reset()
+			if got := ep.LastTTLSource(); got != network.TTLSourceNone {
+				t.Errorf("got ep.LastTTLSource() = %s after reset, want = %s", got, network.TTLSourceNone)
+			}
+		})
+	}
+}
+
 func TestMain(m *testing.M) {
 	refs.SetLeakMode(refs.LeaksPanic)
 	code := m.Run()
@@ -0,0 +1,184 @@
+// Copyright 2023 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"gvisor.dev/gvisor/pkg/sync"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// maxRouteCacheSize is the maximum number of routes an endpoint may cache.
+const maxRouteCacheSize = 256
+
+// routeCacheKey holds the arguments a cached route was found with.
+type routeCacheKey struct {
+	nicID         tcpip.NICID
+	localAddr     tcpip.Address
+	remoteAddr    tcpip.Address
+	netProto      tcpip.NetworkProtocolNumber
+	multicastLoop bool
+}
+
+type routeCacheEntry struct {
+	key   routeCacheKey
+	route *stack.Route
+}
+
+// routeCache is a small least-recently-used cache of routes found for
+// unconnected writes so that repeatedly writing to the same destinations does
+// not require a route table lookup for each write.
+//
+// The cache holds a reference on each cached route. All cached routes are
+// dropped when the stack's route table changes, and a cached route is dropped
+// when it is no longer valid for outgoing packets (e.g. its NIC was disabled
+// or its local address was removed). Routes are dropped as soon as a NIC is
+// removed so that an idle endpoint does not hold on to the removed NIC's
+// addresses.
+type routeCache struct {
+	mu sync.Mutex
+
+	// stack is the stack the cache is registered with to be notified of NIC
+	// removals. It is only set while the cache holds routes.
+	//
+	// +checklocks:mu
+	stack *stack.Stack
+
+	// generation is the stack's route table generation when the cached routes
+	// were found.
+	//
+	// +checklocks:mu
+	generation uint64
+
+	// entries holds the cached routes, most recently used first.
+	//
+	// +checklocks:mu
+	entries []routeCacheEntry
+
+	// misses is the number of lookups that required a route table lookup.
+	//
+	// +checklocks:mu
+	misses uint64
+}
+
+// findRoute returns a route for key, caching up to size routes. The cache is
+// bypassed if size is zero.
+//
+// The caller must release the returned route.
+func (c *routeCache) findRoute(s *stack.Stack, size int, key routeCacheKey) (*stack.Route, tcpip.Error) {
+	if size == 0 {
+		return s.FindRoute(key.nicID, key.localAddr, key.remoteAddr, key.netProto, key.multicastLoop)
+	}
+
+	generation := s.RouteTableGeneration()
+	var released []*stack.Route
+	defer func() {
+		for _, r := range released {
+			r.Release()
+		}
+	}()
+
+	c.mu.Lock()
+	if c.generation != generation {
+		released = c.removeLocked(0, released)
+		c.generation = generation
+	}
+	for i, entry := range c.entries {
+		if entry.key != key {
+			continue
+		}
+		if !entry.route.IsValidForOutgoing() {
+			released = append(released, entry.route)
+			copy(c.entries[i:], c.entries[i+1:])
+			c.entries[len(c.entries)-1] = routeCacheEntry{}
+			c.entries = c.entries[:len(c.entries)-1]
+			break
+		}
+		copy(c.entries[1:i+1], c.entries[:i])
+		c.entries[0] = entry
+		entry.route.Acquire()
+		c.mu.Unlock()
+		return entry.route, nil
+	}
+	c.misses++
+	c.mu.Unlock()
+
+	r, err := s.FindRoute(key.nicID, key.localAddr, key.remoteAddr, key.netProto, key.multicastLoop)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Do not cache a route found with a stale route table or one that raced
+	// with another lookup for the same key.
+	if c.generation != generation {
+		return r, nil
+	}
+	for _, entry := range c.entries {
+		if entry.key == key {
+			return r, nil
+		}
+	}
+	r.Acquire()
+	if c.stack == nil {
+		c.stack = s
+		s.AddNICRemovedHandler(c)
+	}
+	c.entries = append(c.entries, routeCacheEntry{})
+	copy(c.entries[1:], c.entries)
+	c.entries[0] = routeCacheEntry{key: key, route: r}
+	released = c.removeLocked(size, released)
+	return r, nil
+}
+
+// trim drops all but the size most recently used routes.
+func (c *routeCache) trim(size int) {
+	c.mu.Lock()
+	released := c.removeLocked(size, nil)
+	c.mu.Unlock()
+
+	for _, r := range released {
+		r.Release()
+	}
+}
+
+// OnNICRemoved implements stack.NICRemovedHandler.
+//
+// Removing a NIC changes the route table so all cached routes are dropped.
+func (c *routeCache) OnNICRemoved(tcpip.NICID) {
+	c.trim(0)
+}
+
+// removeLocked removes all but the first n entries and returns the removed
+// routes appended to released so that they may be released after c.mu is
+// unlocked.
+//
+// +checklocks:c.mu
+func (c *routeCache) removeLocked(n int, released []*stack.Route) []*stack.Route {
+	if len(c.entries) <= n {
+		return released
+	}
+	for i := n; i < len(c.entries); i++ {
+		released = append(released, c.entries[i].route)
+		c.entries[i] = routeCacheEntry{}
+	}
+	c.entries = c.entries[:n]
+	if len(c.entries) == 0 && c.stack != nil {
+		c.stack.RemoveNICRemovedHandler(c)
+		c.stack = nil
+	}
+	return released
+}
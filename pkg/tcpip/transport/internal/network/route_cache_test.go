@@ -0,0 +1,312 @@
+// Copyright 2023 The gVisor Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package network
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/refs"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/faketime"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/testutil"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+const (
+	nicID1 = 1
+	nicID2 = 2
+)
+
+var (
+	nic1Addr = testutil.MustParse4("10.0.0.1")
+	nic2Addr = testutil.MustParse4("10.0.1.1")
+)
+
+func newRouteCacheTestStack(t testing.TB) *stack.Stack {
+	s := stack.New(stack.Options{
+		NetworkProtocols: []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		Clock:            &faketime.NullClock{},
+	})
+	for nicID, addr := range map[tcpip.NICID]tcpip.Address{
+		nicID1: nic1Addr,
+		nicID2: nic2Addr,
+	} {
+		if err := s.CreateNIC(nicID, channel.New(0, header.IPv4MinimumMTU, "")); err != nil {
+			t.Fatalf("s.CreateNIC(%d, _): %s", nicID, err)
+		}
+		protocolAddr := tcpip.ProtocolAddress{
+			Protocol:          ipv4.ProtocolNumber,
+			AddressWithPrefix: addr.WithPrefix(),
+		}
+		if err := s.AddProtocolAddress(nicID, protocolAddr, stack.AddressProperties{}); err != nil {
+			t.Fatalf("s.AddProtocolAddress(%d, %+v, {}): %s", nicID, protocolAddr, err)
+		}
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID1}})
+	return s
+}
+
+// peerAddr returns the i-th address of the 192.168.0.0/16 subnet.
+func peerAddr(i int) tcpip.Address {
+	return tcpip.AddrFrom4([4]byte{192, 168, byte(i >> 8), byte(i)})
+}
+
+func (e *Endpoint) routeCacheMisses() uint64 {
+	e.routeCache.mu.Lock()
+	defer e.routeCache.mu.Unlock()
+	return e.routeCache.misses
+}
+
+func (e *Endpoint) routeCacheLen() int {
+	e.routeCache.mu.Lock()
+	defer e.routeCache.mu.Unlock()
+	return len(e.routeCache.entries)
+}
+
+func writeTo(e *Endpoint, addr tcpip.Address) (tcpip.NICID, tcpip.Error) {
+	ctx, err := e.AcquireContextForWrite(tcpip.WriteOptions{To: &tcpip.FullAddress{Addr: addr}})
+	if err != nil {
+		return 0, err
+	}
+	defer ctx.Release()
+	return ctx.route.NICID(), nil
+}
+
+func TestRouteCacheSizeOption(t *testing.T) {
+	s := newRouteCacheTestStack(t)
+	defer s.Destroy()
+
+	var ops tcpip.SocketOptions
+	var ep Endpoint
+	var wq waiter.Queue
+	ep.Init(s, ipv4.ProtocolNumber, header.UDPProtocolNumber, &ops, &wq)
+	defer ep.Close()
+
+	if v, err := ep.GetSockOptInt(tcpip.RouteCacheSizeOption); err != nil {
+		t.Fatalf("ep.GetSockOptInt(tcpip.RouteCacheSizeOption): %s", err)
+	} else if v != 0 {
+		t.Errorf("got ep.GetSockOptInt(tcpip.RouteCacheSizeOption) = %d, want = 0", v)
+	}
+	for _, v := range []int{-1, maxRouteCacheSize + 1} {
+		if err := ep.SetSockOptInt(tcpip.RouteCacheSizeOption, v); err == nil {
+			t.Errorf("got ep.SetSockOptInt(tcpip.RouteCacheSizeOption, %d) = nil, want non-nil", v)
+		}
+	}
+
+	// Routes are not cached by default.
+	for i := 0; i < 2; i++ {
+		if _, err := writeTo(&ep, peerAddr(1)); err != nil {
+			t.Fatalf("writeTo(_, %s): %s", peerAddr(1), err)
+		}
+	}
+	if got := ep.routeCacheLen(); got != 0 {
+		t.Errorf("got ep.routeCacheLen() = %d, want = 0", got)
+	}
+
+	const size = 2
+	if err := ep.SetSockOptInt(tcpip.RouteCacheSizeOption, size); err != nil {
+		t.Fatalf("ep.SetSockOptInt(tcpip.RouteCacheSizeOption, %d): %s", size, err)
+	}
+	if v, err := ep.GetSockOptInt(tcpip.RouteCacheSizeOption); err != nil {
+		t.Fatalf("ep.GetSockOptInt(tcpip.RouteCacheSizeOption): %s", err)
+	} else if v != size {
+		t.Errorf("got ep.GetSockOptInt(tcpip.RouteCacheSizeOption) = %d, want = %d", v, size)
+	}
+
+	// Peer 3 evicts the least recently used peer 2 so only the second write to
+	// peer 2 misses.
+	for i, test := range []struct {
+		peer       int
+		wantMisses uint64
+	}{
+		{peer: 1, wantMisses: 1},
+		{peer: 2, wantMisses: 2},
+		{peer: 1, wantMisses: 2},
+		{peer: 3, wantMisses: 3},
+		{peer: 1, wantMisses: 3},
+		{peer: 2, wantMisses: 4},
+	} {
+		if _, err := writeTo(&ep, peerAddr(test.peer)); err != nil {
+			t.Fatalf("%d: writeTo(_, %s): %s", i, peerAddr(test.peer), err)
+		}
+		if got := ep.routeCacheMisses(); got != test.wantMisses {
+			t.Errorf("%d: got ep.routeCacheMisses() = %d, want = %d", i, got, test.wantMisses)
+		}
+	}
+	if got := ep.routeCacheLen(); got != size {
+		t.Errorf("got ep.routeCacheLen() = %d, want = %d", got, size)
+	}
+
+	// Shrinking the cache drops routes immediately.
+	if err := ep.SetSockOptInt(tcpip.RouteCacheSizeOption, 1); err != nil {
+		t.Fatalf("ep.SetSockOptInt(tcpip.RouteCacheSizeOption, 1): %s", err)
+	}
+	if got := ep.routeCacheLen(); got != 1 {
+		t.Errorf("got ep.routeCacheLen() = %d, want = 1", got)
+	}
+
+	ep.Close()
+	if got := ep.routeCacheLen(); got != 0 {
+		t.Errorf("got ep.routeCacheLen() after Close = %d, want = 0", got)
+	}
+}
+
+func TestRouteCacheInvalidation(t *testing.T) {
+	s := newRouteCacheTestStack(t)
+	defer s.Destroy()
+
+	var ops tcpip.SocketOptions
+	var ep Endpoint
+	var wq waiter.Queue
+	ep.Init(s, ipv4.ProtocolNumber, header.UDPProtocolNumber, &ops, &wq)
+	defer ep.Close()
+
+	if err := ep.SetSockOptInt(tcpip.RouteCacheSizeOption, 1); err != nil {
+		t.Fatalf("ep.SetSockOptInt(tcpip.RouteCacheSizeOption, 1): %s", err)
+	}
+
+	peer := peerAddr(1)
+	checkWrite := func(t *testing.T, wantNICID tcpip.NICID, wantMisses uint64) {
+		t.Helper()
+
+		nicID, err := writeTo(&ep, peer)
+		if err != nil {
+			t.Fatalf("writeTo(_, %s): %s", peer, err)
+		}
+		if nicID != wantNICID {
+			t.Errorf("got writeTo(_, %s) = %d, want = %d", peer, nicID, wantNICID)
+		}
+		if got := ep.routeCacheMisses(); got != wantMisses {
+			t.Errorf("got ep.routeCacheMisses() = %d, want = %d", got, wantMisses)
+		}
+	}
+
+	checkWrite(t, nicID1, 1)
+	checkWrite(t, nicID1, 1)
+
+	// Changing the route table invalidates cached routes.
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: nicID2}})
+	checkWrite(t, nicID2, 2)
+	checkWrite(t, nicID2, 2)
+
+	// Disabling the route's NIC invalidates the route.
+	s.AddRoute(tcpip.Route{Destination: header.IPv4EmptySubnet, NIC: nicID1})
+	checkWrite(t, nicID2, 3)
+	if err := s.DisableNIC(nicID2); err != nil {
+		t.Fatalf("s.DisableNIC(%d): %s", nicID2, err)
+	}
+	checkWrite(t, nicID1, 4)
+	checkWrite(t, nicID1, 4)
+
+	// Removing the route's NIC evicts the route.
+	if err := s.RemoveNIC(nicID1); err != nil {
+		t.Fatalf("s.RemoveNIC(%d): %s", nicID1, err)
+	}
+	if _, err := writeTo(&ep, peer); err == nil {
+		t.Errorf("got writeTo(_, %s) = nil, want non-nil", peer)
+	}
+	if got := ep.routeCacheLen(); got != 0 {
+		t.Errorf("got ep.routeCacheLen() = %d, want = 0", got)
+	}
+}
+
+func TestRouteCacheNICRemoval(t *testing.T) {
+	s := newRouteCacheTestStack(t)
+	defer s.Destroy()
+
+	var ops tcpip.SocketOptions
+	var ep Endpoint
+	var wq waiter.Queue
+	ep.Init(s, ipv4.ProtocolNumber, header.UDPProtocolNumber, &ops, &wq)
+	defer ep.Close()
+
+	if err := ep.SetSockOptInt(tcpip.RouteCacheSizeOption, 2); err != nil {
+		t.Fatalf("ep.SetSockOptInt(tcpip.RouteCacheSizeOption, 2): %s", err)
+	}
+	for i := 1; i <= 2; i++ {
+		if _, err := writeTo(&ep, peerAddr(i)); err != nil {
+			t.Fatalf("writeTo(_, %s): %s", peerAddr(i), err)
+		}
+	}
+	if got := ep.routeCacheLen(); got != 2 {
+		t.Fatalf("got ep.routeCacheLen() = %d, want = 2", got)
+	}
+
+	// The cached routes are released as soon as their NIC is removed, without
+	// waiting for the endpoint to write again.
+	if err := s.RemoveNIC(nicID1); err != nil {
+		t.Fatalf("s.RemoveNIC(%d): %s", nicID1, err)
+	}
+	if got := ep.routeCacheLen(); got != 0 {
+		t.Errorf("got ep.routeCacheLen() = %d, want = 0", got)
+	}
+	ep.routeCache.mu.Lock()
+	registered := ep.routeCache.stack != nil
+	ep.routeCache.mu.Unlock()
+	if registered {
+		t.Error("route cache is still registered for NIC removals after dropping its routes")
+	}
+}
+
+// BenchmarkUnconnectedWrite measures acquiring write contexts for a server
+// replying to a set of peers with and without the route cache.
+func BenchmarkUnconnectedWrite(b *testing.B) {
+	const numPeers = 16
+
+	for _, cacheSize := range []int{0, numPeers} {
+		b.Run(fmt.Sprintf("cacheSize=%d", cacheSize), func(b *testing.B) {
+			s := newRouteCacheTestStack(b)
+			defer s.Destroy()
+
+			var ops tcpip.SocketOptions
+			var ep Endpoint
+			var wq waiter.Queue
+			ep.Init(s, ipv4.ProtocolNumber, header.UDPProtocolNumber, &ops, &wq)
+			defer ep.Close()
+
+			if err := ep.SetSockOptInt(tcpip.RouteCacheSizeOption, cacheSize); err != nil {
+				b.Fatalf("ep.SetSockOptInt(tcpip.RouteCacheSizeOption, %d): %s", cacheSize, err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := writeTo(&ep, peerAddr(i%numPeers)); err != nil {
+					b.Fatalf("writeTo(_, %s): %s", peerAddr(i%numPeers), err)
+				}
+			}
+			b.StopTimer()
+
+			// Without the cache, every write finds a route.
+			findRoutes := float64(b.N)
+			if cacheSize != 0 {
+				findRoutes = float64(ep.routeCacheMisses())
+			}
+			b.ReportMetric(findRoutes/float64(b.N), "findroutes/op")
+		})
+	}
+}
+
+func TestMain(m *testing.M) {
+	refs.SetLeakMode(refs.LeaksPanic)
+	code := m.Run()
+	refs.DoLeakCheck()
+	os.Exit(code)
+}
@@ -175,6 +175,16 @@ func (e *endpoint) HasNIC(id int32) bool {
 	return e.stack.HasNIC(tcpip.NICID(id))
 }
 
+// OnSetBindToDevice implements tcpip.SocketOptionsHandler.
+func (e *endpoint) OnSetBindToDevice(id int32) tcpip.Error {
+	return e.net.OnSetBindToDevice(tcpip.NICID(id))
+}
+
+// OnSetV6Only implements tcpip.SocketOptionsHandler.
+func (e *endpoint) OnSetV6Only(bool) tcpip.Error {
+	return e.net.OnSetV6Only()
+}
+
 // Abort implements stack.TransportEndpoint.Abort.
 func (e *endpoint) Abort() {
 	e.Close()
@@ -77,9 +77,6 @@ type endpoint struct {
 	rcvBufSize int
 	rcvClosed  bool
 
-	lastErrorMu sync.Mutex `state:"nosave"`
-	lastError   tcpip.Error
-
 	// The following fields are protected by the mu mutex.
 	mu        sync.RWMutex `state:"nosave"`
 	portFlags ports.Flags
@@ -89,8 +86,6 @@ type endpoint struct {
 	boundBindToDevice tcpip.NICID
 	boundPortFlags    ports.Flags
 
-	readShutdown bool
-
 	// effectiveNetProtos contains the network protocols actually in use. In
 	// most cases it will only contain "netProto", but in cases like IPv6
 	// endpoints with v6only set to false, this could include multiple
@@ -143,20 +138,14 @@ func (e *endpoint) UniqueID() uint64 {
 	return e.uniqueID
 }
 
+// LastError implements tcpip.SocketOptionsHandler.
 func (e *endpoint) LastError() tcpip.Error {
-	e.lastErrorMu.Lock()
-	defer e.lastErrorMu.Unlock()
-
-	err := e.lastError
-	e.lastError = nil
-	return err
+	return e.net.LastError()
 }
 
 // UpdateLastError implements tcpip.SocketOptionsHandler.
 func (e *endpoint) UpdateLastError(err tcpip.Error) {
-	e.lastErrorMu.Lock()
-	e.lastError = err
-	e.lastErrorMu.Unlock()
+	e.net.UpdateLastError(err)
 }
 
 // Abort implements stack.TransportEndpoint.
@@ -206,9 +195,8 @@ func (e *endpoint) Close() {
 	}
 	e.rcvMu.Unlock()
 
-	e.net.Shutdown()
+	e.net.Shutdown(tcpip.ShutdownRead | tcpip.ShutdownWrite)
 	e.net.Close()
-	e.readShutdown = true
 	e.mu.Unlock()
 
 	e.waiterQueue.Notify(waiter.EventHUp | waiter.EventErr | waiter.ReadableEvents | waiter.WritableEvents)
@@ -562,6 +550,36 @@ func (e *endpoint) HasNIC(id int32) bool {
 	return e.stack.HasNIC(tcpip.NICID(id))
 }
 
+// OnSetBindToDevice implements tcpip.SocketOptionsHandler.
+func (e *endpoint) OnSetBindToDevice(id int32) tcpip.Error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	btd := tcpip.NICID(id)
+	return e.net.OnSetBindToDeviceAndThen(btd, func() tcpip.Error {
+		if e.localPort == 0 || btd == e.boundBindToDevice {
+			return nil
+		}
+
+		// Move the registration to the new device so that packets are only
+		// delivered to the endpoint if they arrive on it.
+		id := e.net.Info().ID
+		id.LocalPort = e.localPort
+		id.RemotePort = e.remotePort
+		if err := e.stack.RegisterTransportEndpoint(e.effectiveNetProtos, ProtocolNumber, id, e, e.boundPortFlags, btd); err != nil {
+			return err
+		}
+		e.stack.UnregisterTransportEndpoint(e.effectiveNetProtos, ProtocolNumber, id, e, e.boundPortFlags, e.boundBindToDevice)
+		e.boundBindToDevice = btd
+		return nil
+	})
+}
+
+// OnSetV6Only implements tcpip.SocketOptionsHandler.
+func (e *endpoint) OnSetV6Only(bool) tcpip.Error {
+	return e.net.OnSetV6Only()
+}
+
 // SetSockOpt implements tcpip.Endpoint.
 func (e *endpoint) SetSockOpt(opt tcpip.SettableSocketOption) tcpip.Error {
 	return e.net.SetSockOpt(opt)
@@ -726,15 +744,11 @@ func (e *endpoint) Shutdown(flags tcpip.ShutdownFlags) tcpip.Error {
 		panic(fmt.Sprintf("unhandled state = %s", state))
 	}
 
-	if flags&tcpip.ShutdownWrite != 0 {
-		if err := e.net.Shutdown(); err != nil {
-			return err
-		}
+	if err := e.net.Shutdown(flags); err != nil {
+		return err
 	}
 
 	if flags&tcpip.ShutdownRead != 0 {
-		e.readShutdown = true
-
 		e.rcvMu.Lock()
 		wasClosed := e.rcvClosed
 		e.rcvClosed = true
@@ -897,10 +911,7 @@ func (e *endpoint) Readiness(mask waiter.EventMask) waiter.EventMask {
 		e.rcvMu.Unlock()
 	}
 
-	e.lastErrorMu.Lock()
-	hasError := e.lastError != nil
-	e.lastErrorMu.Unlock()
-	if hasError {
+	if e.net.HasLastError() {
 		result |= waiter.EventErr
 	}
 	return result
@@ -933,6 +944,12 @@ func (e *endpoint) HandlePacket(id stack.TransportEndpointID, pkt stack.PacketBu
 		return
 	}
 
+	// Multicast packets for groups the endpoint has not joined are not meant
+	// for it unless IP_MULTICAST_ALL is enabled.
+	if !e.net.MulticastAllowed(pkt.NICID, id.LocalAddress) {
+		return
+	}
+
 	e.stack.Stats().UDP.PacketsReceived.Increment()
 	e.stats.PacketsReceived.Increment()
 
@@ -1002,9 +1019,7 @@ func (e *endpoint) HandlePacket(id stack.TransportEndpointID, pkt stack.PacketBu
 
 func (e *endpoint) onICMPError(err tcpip.Error, transErr stack.TransportError, pkt stack.PacketBufferPtr) {
 	// Update last error first.
-	e.lastErrorMu.Lock()
-	e.lastError = err
-	e.lastErrorMu.Unlock()
+	e.net.UpdateLastError(err)
 
 	var recvErr bool
 	switch pkt.NetworkProtocolNumber {
@@ -1053,6 +1068,8 @@ func (e *endpoint) onICMPError(err tcpip.Error, transErr stack.TransportError, p
 func (e *endpoint) HandleError(transErr stack.TransportError, pkt stack.PacketBufferPtr) {
 	// TODO(gvisor.dev/issues/5270): Handle all transport errors.
 	switch transErr.Kind() {
+	case stack.PacketTooBigTransportError:
+		e.net.HandlePacketTooBig(transErr.Info())
 	case stack.DestinationPortUnreachableTransportError:
 		if e.net.State() == transport.DatagramEndpointStateConnected {
 			e.onICMPError(&tcpip.ErrConnectionRefused{}, transErr, pkt)
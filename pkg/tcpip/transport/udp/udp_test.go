@@ -131,6 +131,35 @@ func TestBindToDeviceOption(t *testing.T) {
 	}
 }
 
+// TestBindToDeviceAfterBind checks that changing the device of a bound
+// endpoint changes the NIC packets are delivered to it from.
+func TestBindToDeviceAfterBind(t *testing.T) {
+	const otherNICID = context.NICID + 1
+
+	c := context.New(t, []stack.TransportProtocolFactory{udp.NewProtocol, icmp.NewProtocol6, icmp.NewProtocol4})
+	defer c.Cleanup()
+
+	if err := c.Stack.CreateNIC(otherNICID, loopback.New()); err != nil {
+		c.T.Fatalf("CreateNIC(%d, _): %s", otherNICID, err)
+	}
+
+	c.CreateEndpointForFlow(context.UnicastV4, udp.ProtocolNumber)
+	if err := c.EP.Bind(tcpip.FullAddress{Port: context.StackPort}); err != nil {
+		c.T.Fatalf("Bind failed: %s", err)
+	}
+	testRead(c, context.UnicastV4)
+
+	if err := c.EP.SocketOptions().SetBindToDevice(otherNICID); err != nil {
+		c.T.Fatalf("SetBindToDevice(%d): %s", otherNICID, err)
+	}
+	testFailingRead(c, context.UnicastV4, false /* expectReadError */)
+
+	if err := c.EP.SocketOptions().SetBindToDevice(context.NICID); err != nil {
+		c.T.Fatalf("SetBindToDevice(%d): %s", context.NICID, err)
+	}
+	testRead(c, context.UnicastV4)
+}
+
 func TestBindEphemeralPort(t *testing.T) {
 	c := context.New(t, []stack.TransportProtocolFactory{udp.NewProtocol, icmp.NewProtocol6, icmp.NewProtocol4})
 	defer c.Cleanup()
@@ -358,6 +387,40 @@ func TestReadOnBoundToMulticast(t *testing.T) {
 	}
 }
 
+// TestReadMulticastAll checks that an endpoint only receives packets for
+// multicast groups it has not joined when IP_MULTICAST_ALL is enabled.
+func TestReadMulticastAll(t *testing.T) {
+	for _, flow := range []context.TestFlow{context.MulticastV4, context.MulticastV6, context.MulticastV6Only} {
+		t.Run(fmt.Sprintf("flow:%s", flow), func(t *testing.T) {
+			c := context.New(t, []stack.TransportProtocolFactory{udp.NewProtocol, icmp.NewProtocol6, icmp.NewProtocol4})
+			defer c.Cleanup()
+
+			c.CreateEndpointForFlow(flow, udp.ProtocolNumber)
+			if err := c.EP.Bind(tcpip.FullAddress{Port: context.StackPort}); err != nil {
+				c.T.Fatalf("Bind failed: %s", err)
+			}
+
+			// Join the group on the NIC but not on the endpoint.
+			mcastAddr := flow.GetMulticastAddr()
+			if err := c.Stack.JoinGroup(flow.NetProto(), context.NICID, mcastAddr); err != nil {
+				c.T.Fatalf("JoinGroup(%d, %d, %s): %s", flow.NetProto(), context.NICID, mcastAddr, err)
+			}
+			testRead(c, flow)
+
+			if err := c.EP.SetSockOptInt(tcpip.MulticastAllOption, 0); err != nil {
+				c.T.Fatalf("SetSockOptInt(tcpip.MulticastAllOption, 0): %s", err)
+			}
+			testFailingRead(c, flow, false /* expectReadError */)
+
+			ifoptSet := tcpip.AddMembershipOption{NIC: context.NICID, MulticastAddr: mcastAddr}
+			if err := c.EP.SetSockOpt(&ifoptSet); err != nil {
+				c.T.Fatalf("SetSockOpt(&%#v): %s", ifoptSet, err)
+			}
+			testRead(c, flow)
+		})
+	}
+}
+
 // TestV4ReadOnBoundToBroadcast checks that an endpoint can bind to a broadcast
 // address and can receive only broadcast data.
 func TestV4ReadOnBoundToBroadcast(t *testing.T) {
@@ -774,7 +837,21 @@ func TestV4WriteOnV6Only(t *testing.T) {
 			c.CreateEndpointForFlow(context.UnicastV6Only, udp.ProtocolNumber)
 
 			// Write to V4 mapped address.
-			testWriteOpSequenceFails(c, context.UnicastV4in6, writeOpSequence, &tcpip.ErrHostUnreachable{})
+			testWriteOpSequenceFails(c, context.UnicastV4in6, writeOpSequence, &tcpip.ErrNetworkUnreachable{})
+		})
+	}
+}
+
+func TestV6WriteOnV4(t *testing.T) {
+	for name, writeOpSequence := range writeOpSequences {
+		t.Run(name, func(t *testing.T) {
+			c := context.New(t, []stack.TransportProtocolFactory{udp.NewProtocol, icmp.NewProtocol6, icmp.NewProtocol4})
+			defer c.Cleanup()
+
+			c.CreateEndpoint(ipv4.ProtocolNumber, udp.ProtocolNumber)
+
+			// Write to v6 address.
+			testWriteOpSequenceFails(c, context.UnicastV6, writeOpSequence, &tcpip.ErrAddressFamilyNotSupported{})
 		})
 	}
 }
@@ -182,6 +182,31 @@ TEST_F(RawHDRINCL, SendWithoutConnectFails) {
               SyscallFailsWithErrno(EDESTADDRREQ));
 }
 
+// Like other sockets, HDRINCL sockets may only send to a broadcast address if
+// SO_BROADCAST is set.
+TEST_F(RawHDRINCL, SendToBroadcastRequiresSoBroadcast) {
+  // Bind to the loopback device so that the broadcast does not need a route.
+  ASSERT_THAT(setsockopt(socket_, SOL_SOCKET, SO_BINDTODEVICE, "lo",
+                         sizeof("lo")),
+              SyscallSucceeds());
+
+  struct iphdr hdr = LoopbackHeader();
+  hdr.daddr = htonl(INADDR_BROADCAST);
+  struct sockaddr_in addr = addr_;
+  addr.sin_addr.s_addr = htonl(INADDR_BROADCAST);
+  EXPECT_THAT(sendto(socket_, &hdr, sizeof(hdr), 0,
+                     reinterpret_cast<struct sockaddr*>(&addr), sizeof(addr)),
+              SyscallFailsWithErrno(EACCES));
+
+  constexpr int kSockOptOn = 1;
+  ASSERT_THAT(setsockopt(socket_, SOL_SOCKET, SO_BROADCAST, &kSockOptOn,
+                         sizeof(kSockOptOn)),
+              SyscallSucceeds());
+  EXPECT_THAT(sendto(socket_, &hdr, sizeof(hdr), 0,
+                     reinterpret_cast<struct sockaddr*>(&addr), sizeof(addr)),
+              SyscallSucceedsWithValue(sizeof(hdr)));
+}
+
 // HDRINCL implies write-only. Verify that we can't read a packet sent to
 // loopback.
 TEST_F(RawHDRINCL, NotReadableAfterWrite) {
@@ -25,6 +25,7 @@
 #include "gtest/gtest.h"
 #include "absl/memory/memory.h"
 #include "test/syscalls/linux/ip_socket_test_util.h"
+#include "test/util/capability_util.h"
 #include "test/util/test_util.h"
 
 namespace gvisor {
@@ -2326,5 +2327,187 @@ TEST_P(IPv4UDPUnboundSocketTest, IpMulticastIPPacketInfo) {
   EXPECT_EQ(received_pktinfo.ipi_addr.s_addr, group.imr_multiaddr.s_addr);
 }
 
+// Test that the IP_UNICAST_IF interface index is in network byte order.
+TEST_P(IPv4UDPUnboundSocketTest, SetAndGetUnicastIf) {
+  auto socket = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+
+  int get = -1;
+  socklen_t get_len = sizeof(get);
+  ASSERT_THAT(
+      getsockopt(socket->get(), IPPROTO_IP, IP_UNICAST_IF, &get, &get_len),
+      SyscallSucceedsWithValue(0));
+  EXPECT_EQ(get_len, sizeof(get));
+  EXPECT_EQ(get, 0);
+
+  const int ifindex = htonl(ASSERT_NO_ERRNO_AND_VALUE(GetLoopbackIndex()));
+  ASSERT_THAT(setsockopt(socket->get(), IPPROTO_IP, IP_UNICAST_IF, &ifindex,
+                         sizeof(ifindex)),
+              SyscallSucceeds());
+
+  get_len = sizeof(get);
+  ASSERT_THAT(
+      getsockopt(socket->get(), IPPROTO_IP, IP_UNICAST_IF, &get, &get_len),
+      SyscallSucceedsWithValue(0));
+  EXPECT_EQ(get_len, sizeof(get));
+  EXPECT_EQ(get, ifindex);
+
+  // Zero clears the interface.
+  constexpr int kNoInterface = 0;
+  ASSERT_THAT(setsockopt(socket->get(), IPPROTO_IP, IP_UNICAST_IF,
+                         &kNoInterface, sizeof(kNoInterface)),
+              SyscallSucceeds());
+
+  get_len = sizeof(get);
+  ASSERT_THAT(
+      getsockopt(socket->get(), IPPROTO_IP, IP_UNICAST_IF, &get, &get_len),
+      SyscallSucceedsWithValue(0));
+  EXPECT_EQ(get_len, sizeof(get));
+  EXPECT_EQ(get, 0);
+}
+
+TEST_P(IPv4UDPUnboundSocketTest, SetUnicastIfInvalidLength) {
+  auto socket = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+
+  const int ifindex = htonl(ASSERT_NO_ERRNO_AND_VALUE(GetLoopbackIndex()));
+  EXPECT_THAT(setsockopt(socket->get(), IPPROTO_IP, IP_UNICAST_IF, &ifindex,
+                         sizeof(ifindex) - 1),
+              SyscallFailsWithErrno(EINVAL));
+
+  const int64_t long_ifindex = ifindex;
+  EXPECT_THAT(setsockopt(socket->get(), IPPROTO_IP, IP_UNICAST_IF,
+                         &long_ifindex, sizeof(long_ifindex)),
+              SyscallFailsWithErrno(EINVAL));
+}
+
+TEST_P(IPv4UDPUnboundSocketTest, SetUnicastIfBoundToDevice) {
+  SKIP_IF(!ASSERT_NO_ERRNO_AND_VALUE(HaveCapability(CAP_NET_RAW)));
+
+  auto socket = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+  ASSERT_THAT(setsockopt(socket->get(), SOL_SOCKET, SO_BINDTODEVICE, "lo",
+                         sizeof("lo")),
+              SyscallSucceeds());
+
+  // An interface may not be set once the socket is bound to a device, not even
+  // the bound device itself.
+  const int ifindex = htonl(ASSERT_NO_ERRNO_AND_VALUE(GetLoopbackIndex()));
+  EXPECT_THAT(setsockopt(socket->get(), IPPROTO_IP, IP_UNICAST_IF, &ifindex,
+                         sizeof(ifindex)),
+              SyscallFailsWithErrno(EINVAL));
+
+  constexpr int kNoInterface = 0;
+  EXPECT_THAT(setsockopt(socket->get(), IPPROTO_IP, IP_UNICAST_IF,
+                         &kNoInterface, sizeof(kNoInterface)),
+              SyscallSucceeds());
+}
+
+TEST_P(IPv4UDPUnboundSocketTest, SetAndGetMulticastAll) {
+  auto socket = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+
+  // IP_MULTICAST_ALL is enabled by default.
+  int get = -1;
+  socklen_t get_len = sizeof(get);
+  ASSERT_THAT(
+      getsockopt(socket->get(), IPPROTO_IP, IP_MULTICAST_ALL, &get, &get_len),
+      SyscallSucceedsWithValue(0));
+  EXPECT_EQ(get_len, sizeof(get));
+  EXPECT_EQ(get, kSockOptOn);
+
+  ASSERT_THAT(setsockopt(socket->get(), IPPROTO_IP, IP_MULTICAST_ALL,
+                         &kSockOptOff, sizeof(kSockOptOff)),
+              SyscallSucceeds());
+  get_len = sizeof(get);
+  ASSERT_THAT(
+      getsockopt(socket->get(), IPPROTO_IP, IP_MULTICAST_ALL, &get, &get_len),
+      SyscallSucceedsWithValue(0));
+  EXPECT_EQ(get_len, sizeof(get));
+  EXPECT_EQ(get, kSockOptOff);
+
+  // Only 0 and 1 are accepted.
+  constexpr int kInvalid = 2;
+  EXPECT_THAT(setsockopt(socket->get(), IPPROTO_IP, IP_MULTICAST_ALL,
+                         &kInvalid, sizeof(kInvalid)),
+              SyscallFailsWithErrno(EINVAL));
+  get_len = sizeof(get);
+  ASSERT_THAT(
+      getsockopt(socket->get(), IPPROTO_IP, IP_MULTICAST_ALL, &get, &get_len),
+      SyscallSucceedsWithValue(0));
+  EXPECT_EQ(get_len, sizeof(get));
+  EXPECT_EQ(get, kSockOptOff);
+}
+
+// Check that a socket listening on ANY only receives packets for a group
+// joined by another socket if IP_MULTICAST_ALL is enabled.
+TEST_P(IPv4UDPUnboundSocketTest, TestMcastReceptionWithoutMembership) {
+  // TODO(b/267210840): Get multicast working with hostinet.
+  SKIP_IF(IsRunningWithHostinet());
+
+  auto sender = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+  auto member = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+  auto non_member = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+
+  ip_mreq iface = {}, group = {};
+  iface.imr_interface.s_addr = htonl(INADDR_LOOPBACK);
+  group.imr_multiaddr.s_addr = inet_addr(kMulticastAddress);
+  group.imr_interface.s_addr = htonl(INADDR_LOOPBACK);
+  ASSERT_THAT(setsockopt(sender->get(), IPPROTO_IP, IP_MULTICAST_IF, &iface,
+                         sizeof(iface)),
+              SyscallSucceeds());
+  ASSERT_THAT(setsockopt(member->get(), IPPROTO_IP, IP_ADD_MEMBERSHIP, &group,
+                         sizeof(group)),
+              SyscallSucceeds());
+
+  // Bind both receivers to the same port on ANY.
+  auto receiver_addr = V4Any();
+  for (auto* fd : {member.get(), non_member.get()}) {
+    ASSERT_THAT(setsockopt(fd->get(), SOL_SOCKET, SO_REUSEPORT, &kSockOptOn,
+                           sizeof(kSockOptOn)),
+                SyscallSucceeds());
+    ASSERT_THAT(bind(fd->get(), AsSockAddr(&receiver_addr.addr),
+                     receiver_addr.addr_len),
+                SyscallSucceeds());
+    socklen_t receiver_addr_len = receiver_addr.addr_len;
+    ASSERT_THAT(getsockname(fd->get(), AsSockAddr(&receiver_addr.addr),
+                            &receiver_addr_len),
+                SyscallSucceeds());
+    EXPECT_EQ(receiver_addr_len, receiver_addr.addr_len);
+  }
+
+  auto send_addr = V4Multicast();
+  reinterpret_cast<sockaddr_in*>(&send_addr.addr)->sin_port =
+      reinterpret_cast<sockaddr_in*>(&receiver_addr.addr)->sin_port;
+  char send_buf[200];
+  char recv_buf[sizeof(send_buf)] = {};
+
+  // With IP_MULTICAST_ALL enabled, both sockets receive the packet.
+  RandomizeBuffer(send_buf, sizeof(send_buf));
+  ASSERT_THAT(
+      RetryEINTR(sendto)(sender->get(), send_buf, sizeof(send_buf), 0,
+                         AsSockAddr(&send_addr.addr), send_addr.addr_len),
+      SyscallSucceedsWithValue(sizeof(send_buf)));
+  for (auto* fd : {member.get(), non_member.get()}) {
+    ASSERT_THAT(RecvTimeout(fd->get(), recv_buf, sizeof(recv_buf),
+                            1 /*timeout*/),
+                IsPosixErrorOkAndHolds(sizeof(recv_buf)));
+    EXPECT_EQ(0, memcmp(send_buf, recv_buf, sizeof(send_buf)));
+  }
+
+  // With IP_MULTICAST_ALL disabled, only the member receives the packet.
+  ASSERT_THAT(setsockopt(non_member->get(), IPPROTO_IP, IP_MULTICAST_ALL,
+                         &kSockOptOff, sizeof(kSockOptOff)),
+              SyscallSucceeds());
+  RandomizeBuffer(send_buf, sizeof(send_buf));
+  ASSERT_THAT(
+      RetryEINTR(sendto)(sender->get(), send_buf, sizeof(send_buf), 0,
+                         AsSockAddr(&send_addr.addr), send_addr.addr_len),
+      SyscallSucceedsWithValue(sizeof(send_buf)));
+  ASSERT_THAT(RecvTimeout(member->get(), recv_buf, sizeof(recv_buf),
+                          1 /*timeout*/),
+              IsPosixErrorOkAndHolds(sizeof(recv_buf)));
+  EXPECT_EQ(0, memcmp(send_buf, recv_buf, sizeof(send_buf)));
+  EXPECT_THAT(RecvTimeout(non_member->get(), recv_buf, sizeof(recv_buf),
+                          1 /*timeout*/),
+              PosixErrorIs(EAGAIN, ::testing::_));
+}
+
 }  // namespace testing
 }  // namespace gvisor
@@ -31,6 +31,7 @@
 #include "gtest/gtest.h"
 #include "absl/memory/memory.h"
 #include "test/syscalls/linux/ip_socket_test_util.h"
+#include "test/util/capability_util.h"
 #include "test/util/posix_error.h"
 #include "test/util/save_util.h"
 #include "test/util/socket_util.h"
@@ -202,5 +203,91 @@ TEST_P(IPv6UDPUnboundSocketTest, SetAndReceiveIPReceiveOrigDstAddr) {
   EXPECT_EQ(received_addr.sin6_port, orig_receiver_addr->sin6_port);
 }
 
+// Test that the IPV6_UNICAST_IF interface index is in network byte order.
+TEST_P(IPv6UDPUnboundSocketTest, SetAndGetIPv6UnicastIf) {
+  auto socket = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+
+  int get = -1;
+  socklen_t get_len = sizeof(get);
+  ASSERT_THAT(
+      getsockopt(socket->get(), IPPROTO_IPV6, IPV6_UNICAST_IF, &get, &get_len),
+      SyscallSucceedsWithValue(0));
+  EXPECT_EQ(get_len, sizeof(get));
+  EXPECT_EQ(get, 0);
+
+  const int ifindex = htonl(ASSERT_NO_ERRNO_AND_VALUE(GetLoopbackIndex()));
+  ASSERT_THAT(setsockopt(socket->get(), IPPROTO_IPV6, IPV6_UNICAST_IF, &ifindex,
+                         sizeof(ifindex)),
+              SyscallSucceeds());
+
+  get_len = sizeof(get);
+  ASSERT_THAT(
+      getsockopt(socket->get(), IPPROTO_IPV6, IPV6_UNICAST_IF, &get, &get_len),
+      SyscallSucceedsWithValue(0));
+  EXPECT_EQ(get_len, sizeof(get));
+  EXPECT_EQ(get, ifindex);
+
+  // Zero clears the interface.
+  constexpr int kNoInterface = 0;
+  ASSERT_THAT(setsockopt(socket->get(), IPPROTO_IPV6, IPV6_UNICAST_IF,
+                         &kNoInterface, sizeof(kNoInterface)),
+              SyscallSucceeds());
+
+  get_len = sizeof(get);
+  ASSERT_THAT(
+      getsockopt(socket->get(), IPPROTO_IPV6, IPV6_UNICAST_IF, &get, &get_len),
+      SyscallSucceedsWithValue(0));
+  EXPECT_EQ(get_len, sizeof(get));
+  EXPECT_EQ(get, 0);
+}
+
+// IPV6_UNICAST_IF and IP_UNICAST_IF are independent of each other.
+TEST_P(IPv6UDPUnboundSocketTest, IPv6UnicastIfIndependentOfIPv4) {
+  auto socket = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+
+  const int ifindex = htonl(ASSERT_NO_ERRNO_AND_VALUE(GetLoopbackIndex()));
+  ASSERT_THAT(setsockopt(socket->get(), IPPROTO_IPV6, IPV6_UNICAST_IF, &ifindex,
+                         sizeof(ifindex)),
+              SyscallSucceeds());
+
+  int get = -1;
+  socklen_t get_len = sizeof(get);
+  ASSERT_THAT(
+      getsockopt(socket->get(), IPPROTO_IP, IP_UNICAST_IF, &get, &get_len),
+      SyscallSucceedsWithValue(0));
+  EXPECT_EQ(get_len, sizeof(get));
+  EXPECT_EQ(get, 0);
+}
+
+TEST_P(IPv6UDPUnboundSocketTest, SetIPv6UnicastIfInvalidLength) {
+  auto socket = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+
+  const int ifindex = htonl(ASSERT_NO_ERRNO_AND_VALUE(GetLoopbackIndex()));
+  EXPECT_THAT(setsockopt(socket->get(), IPPROTO_IPV6, IPV6_UNICAST_IF, &ifindex,
+                         sizeof(ifindex) - 1),
+              SyscallFailsWithErrno(EINVAL));
+
+  const int64_t long_ifindex = ifindex;
+  EXPECT_THAT(setsockopt(socket->get(), IPPROTO_IPV6, IPV6_UNICAST_IF,
+                         &long_ifindex, sizeof(long_ifindex)),
+              SyscallFailsWithErrno(EINVAL));
+}
+
+// Unlike IP_UNICAST_IF, IPV6_UNICAST_IF accepts the device the socket is bound
+// to.
+TEST_P(IPv6UDPUnboundSocketTest, SetIPv6UnicastIfBoundToDevice) {
+  SKIP_IF(!ASSERT_NO_ERRNO_AND_VALUE(HaveCapability(CAP_NET_RAW)));
+
+  auto socket = ASSERT_NO_ERRNO_AND_VALUE(NewSocket());
+  ASSERT_THAT(setsockopt(socket->get(), SOL_SOCKET, SO_BINDTODEVICE, "lo",
+                         sizeof("lo")),
+              SyscallSucceeds());
+
+  const int ifindex = htonl(ASSERT_NO_ERRNO_AND_VALUE(GetLoopbackIndex()));
+  EXPECT_THAT(setsockopt(socket->get(), IPPROTO_IPV6, IPV6_UNICAST_IF, &ifindex,
+                         sizeof(ifindex)),
+              SyscallSucceeds());
+}
+
 }  // namespace testing
 }  // namespace gvisor
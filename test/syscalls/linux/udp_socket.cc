@@ -2190,6 +2190,34 @@ TEST_P(UdpSocketControlMessagesTest, SendAndReceiveTOSorTClass) {
   EXPECT_EQ(recv_data_len, sizeof(sent_data));
 }
 
+TEST_P(UdpSocketControlMessagesTest, SendDefaultTClassUsesSocketTClass) {
+  // IPV6_TCLASS control messages only apply to IPv6 packets.
+  SKIP_IF(ClientAddressFamily() != AF_INET6);
+
+  ASSERT_THAT(setsockopt(server_.get(), SOL_IPV6, IPV6_RECVTCLASS, &kSockOptOn,
+                         sizeof(kSockOptOn)),
+              SyscallSucceeds());
+
+  constexpr int kTClass = IPTOS_THROUGHPUT;
+  ASSERT_THAT(setsockopt(client_.get(), SOL_IPV6, IPV6_TCLASS, &kTClass,
+                         sizeof(kTClass)),
+              SyscallSucceeds());
+
+  // A traffic class of -1 in the control message selects the socket's.
+  constexpr size_t kArbitrarySendSize = 1024;
+  char sent_data[kArbitrarySendSize] = {};
+  ASSERT_NO_FATAL_FAILURE(
+      SendTClass(client_.get(), sent_data, size_t(sizeof(sent_data)), -1));
+
+  char recv_data[sizeof(sent_data) + 1];
+  size_t recv_data_len = sizeof(recv_data);
+  int tclass;
+  ASSERT_NO_FATAL_FAILURE(
+      RecvTClass(server_.get(), recv_data, &recv_data_len, &tclass));
+  EXPECT_EQ(tclass, kTClass);
+  EXPECT_EQ(recv_data_len, sizeof(sent_data));
+}
+
 TEST_P(UdpSocketControlMessagesTest, SetAndReceiveTTLOrHopLimit) {
   // Enable receiving TTL and maybe HOPLIMIT on the receiver.
   ASSERT_THAT(setsockopt(server_.get(), SOL_IP, IP_RECVTTL, &kSockOptOn,
@@ -2478,6 +2506,94 @@ TEST(UdpInet6SocketTest, ConnectInet4Sockaddr) {
   ASSERT_TRUE(IN6_IS_ADDR_V4MAPPED(sin6->sin6_addr.s6_addr)) << addr;
 }
 
+TEST(UdpInet6SocketTest, AddrFormConvertsToInet4) {
+  auto server =
+      ASSERT_NO_ERRNO_AND_VALUE(Socket(AF_INET, SOCK_DGRAM, IPPROTO_UDP));
+  auto server_addr = V4Loopback();
+  ASSERT_THAT(bind(server.get(), AsSockAddr(&server_addr.addr),
+                   server_addr.addr_len),
+              SyscallSucceeds());
+  ASSERT_THAT(getsockname(server.get(), AsSockAddr(&server_addr.addr),
+                          &server_addr.addr_len),
+              SyscallSucceeds());
+  const uint16_t port =
+      reinterpret_cast<sockaddr_in*>(&server_addr.addr)->sin_port;
+
+  auto sock =
+      ASSERT_NO_ERRNO_AND_VALUE(Socket(AF_INET6, SOCK_DGRAM, IPPROTO_UDP));
+  auto connect_addr = V4MappedLoopback();
+  reinterpret_cast<sockaddr_in6*>(&connect_addr.addr)->sin6_port = port;
+  ASSERT_THAT(connect(sock.get(), AsSockAddr(&connect_addr.addr),
+                      connect_addr.addr_len),
+              SyscallSucceeds());
+
+  constexpr int kInet = AF_INET;
+  ASSERT_THAT(setsockopt(sock.get(), IPPROTO_IPV6, IPV6_ADDRFORM, &kInet,
+                         sizeof(kInet)),
+              SyscallSucceeds());
+
+  // The socket's addresses are now reported as IPv4 addresses.
+  sockaddr_storage addr;
+  socklen_t addr_len = sizeof(addr);
+  ASSERT_THAT(getsockname(sock.get(), AsSockAddr(&addr), &addr_len),
+              SyscallSucceeds());
+  EXPECT_EQ(addr.ss_family, AF_INET);
+  EXPECT_EQ(addr_len, sizeof(sockaddr_in));
+  EXPECT_EQ(reinterpret_cast<sockaddr_in*>(&addr)->sin_addr.s_addr,
+            htonl(INADDR_LOOPBACK));
+
+  addr_len = sizeof(addr);
+  ASSERT_THAT(getpeername(sock.get(), AsSockAddr(&addr), &addr_len),
+              SyscallSucceeds());
+  EXPECT_EQ(addr.ss_family, AF_INET);
+  EXPECT_EQ(addr_len, sizeof(sockaddr_in));
+  EXPECT_EQ(reinterpret_cast<sockaddr_in*>(&addr)->sin_addr.s_addr,
+            htonl(INADDR_LOOPBACK));
+  EXPECT_EQ(reinterpret_cast<sockaddr_in*>(&addr)->sin_port, port);
+
+  // The socket still sends to its peer.
+  constexpr char kData[] = "addrform";
+  ASSERT_THAT(send(sock.get(), kData, sizeof(kData), 0),
+              SyscallSucceedsWithValue(sizeof(kData)));
+  char buf[sizeof(kData)];
+  ASSERT_THAT(RetryEINTR(recv)(server.get(), buf, sizeof(buf), 0),
+              SyscallSucceedsWithValue(sizeof(kData)));
+  EXPECT_EQ(memcmp(buf, kData, sizeof(kData)), 0);
+
+  // IPv6 options no longer apply to the socket.
+  EXPECT_THAT(setsockopt(sock.get(), IPPROTO_IPV6, IPV6_ADDRFORM, &kInet,
+                         sizeof(kInet)),
+              SyscallFailsWithErrno(ENOPROTOOPT));
+}
+
+TEST(UdpInet6SocketTest, AddrFormErrors) {
+  constexpr int kInet = AF_INET;
+  constexpr int kInet6 = AF_INET6;
+
+  auto sock =
+      ASSERT_NO_ERRNO_AND_VALUE(Socket(AF_INET6, SOCK_DGRAM, IPPROTO_UDP));
+
+  // Only conversion to IPv4 is supported.
+  EXPECT_THAT(setsockopt(sock.get(), IPPROTO_IPV6, IPV6_ADDRFORM, &kInet6,
+                         sizeof(kInet6)),
+              SyscallFailsWithErrno(EINVAL));
+
+  // The socket must be connected.
+  EXPECT_THAT(setsockopt(sock.get(), IPPROTO_IPV6, IPV6_ADDRFORM, &kInet,
+                         sizeof(kInet)),
+              SyscallFailsWithErrno(ENOTCONN));
+
+  // The peer must be an IPv4-mapped address.
+  auto connect_addr = V6Loopback();
+  reinterpret_cast<sockaddr_in6*>(&connect_addr.addr)->sin6_port = htons(1);
+  ASSERT_THAT(connect(sock.get(), AsSockAddr(&connect_addr.addr),
+                      connect_addr.addr_len),
+              SyscallSucceeds());
+  EXPECT_THAT(setsockopt(sock.get(), IPPROTO_IPV6, IPV6_ADDRFORM, &kInet,
+                         sizeof(kInet)),
+              SyscallFailsWithErrno(EADDRNOTAVAIL));
+}
+
 }  // namespace
 
 }  // namespace testing